@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+type Album struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	MediaCount int    `json:"media_count"`
+	CreatedAt  int64  `json:"created_at"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
+
+type AlbumResponse struct {
+	ApiResponse
+	Album Album `json:"album"`
+}
+
+type AlbumListResponse struct {
+	ApiResponse
+	Albums []Album `json:"albums"`
+}
+
+func (api *API) ListAlbums() (albums []Album, err error) {
+	return api.ListAlbumsContext(context.Background())
+}
+
+// ListAlbumsContext fetches every album in the account.
+func (api *API) ListAlbumsContext(ctx context.Context) (albums []Album, err error) {
+	response := new(AlbumListResponse)
+	_, err = api.CallAndParseIntoWithOutputContext(ctx, "albums/index", url.Values{}, response, false)
+	if err != nil {
+		return
+	}
+
+	albums = response.Albums
+	return
+}
+
+func (api *API) CreateAlbum(name string) (album Album, err error) {
+	return api.CreateAlbumContext(context.Background(), name)
+}
+
+// CreateAlbumContext creates an empty album called name.
+func (api *API) CreateAlbumContext(ctx context.Context, name string) (album Album, err error) {
+	params := url.Values{}
+	params.Add("name", name)
+
+	response := new(AlbumResponse)
+	_, err = api.CallAndParseIntoWithOutputContext(ctx, "albums/create", params, response, false)
+	if err != nil {
+		return
+	}
+
+	album = response.Album
+	return
+}
+
+func (api *API) AddMediaToAlbum(albumId string, mediaIds []string) error {
+	return api.AddMediaToAlbumContext(context.Background(), albumId, mediaIds)
+}
+
+// AddMediaToAlbumContext adds the given media to an album. Media already in
+// the album are left as they are.
+func (api *API) AddMediaToAlbumContext(ctx context.Context, albumId string, mediaIds []string) error {
+	params := url.Values{}
+	params.Add("id", albumId)
+	params.Add("media_ids", strings.Join(mediaIds, ","))
+
+	response := new(AlbumResponse)
+	_, err := api.CallAndParseIntoWithOutputContext(ctx, "albums/add_media", params, response, false)
+	return err
+}
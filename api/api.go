@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -19,17 +21,25 @@ type ClientCredentials struct {
 }
 
 type API struct {
-	AccessToken  AccessToken
 	Host         string
 	ServicesHost string
 	Port         string
 	ServicesPort string
 	ClientCredentials
+	httpClient          *http.Client
+	retryPolicy         *RetryPolicy
+	tokenRefreshHandler func(AccessToken)
+	signatureBatchSize  int
+	chunkSize           int64
+	bandwidthLimiter    *BandwidthLimiter
+	tracing             bool
+	session             *session
 }
 
 type APIInterface interface {
 	MakeFullPath(path string) string
 	PostWithToken(path string, values url.Values) (resp *http.Response, err error)
+	PostWithTokenContext(ctx context.Context, path string, values url.Values) (resp *http.Response, err error)
 }
 
 func (api *API) MakeFullPath(path string) string {
@@ -40,26 +50,79 @@ func (api *API) MakeFullPath(path string) string {
 	return fmt.Sprintf("%s%s/%s", api.Host, port, path)
 }
 
+// MakeServicesPath returns the URL of path on the services (Ruler) host.
+func (api *API) MakeServicesPath(path string) string {
+	port := ""
+	if api.ServicesPort != "" {
+		port = fmt.Sprintf(":%s", api.ServicesPort)
+	}
+	return fmt.Sprintf("%s%s/%s", api.ServicesHost, port, path)
+}
+
 func (api *API) PostWithToken(path string, values url.Values) (resp *http.Response, err error) {
-	if api.AccessToken.Token != "" {
-		values.Add("access_token", api.AccessToken.Token)
+	return api.PostWithTokenContext(context.Background(), path, values)
+}
+
+func (api *API) PostWithTokenContext(ctx context.Context, path string, values url.Values) (resp *http.Response, err error) {
+	// Token requests authenticate with the client credentials, and calls that
+	// set their own access_token (or are being retried) keep it.
+	_, hasToken := values["access_token"]
+	if token := api.Token().Token; token != "" && !hasToken && path != "oauth/access_token" {
+		values.Add("access_token", token)
 	}
 	dest := api.MakeFullPath(path)
 	//fmt.Println(dest)
-	return http.PostForm(dest, values)
+	req, err := http.NewRequestWithContext(ctx, "POST", dest, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return api.do(req)
 }
 
-func (api *API) CallAndParseIntoWithOutput(path string, values url.Values, parseInto BasicResponse, output bool) int64 {
+func (api *API) CallAndParseIntoWithOutput(path string, values url.Values, parseInto BasicResponse, output bool) (int64, error) {
+	return api.CallAndParseIntoWithOutputContext(context.Background(), path, values, parseInto, output)
+}
+
+func (api *API) CallAndParseIntoWithOutputContext(ctx context.Context, path string, values url.Values, parseInto BasicResponse, output bool) (time int64, err error) {
+	if strings.HasPrefix(path, "oauth/") {
+		return api.callWithRetry(ctx, path, values, parseInto, output)
+	}
+
+	api.ensureFreshToken(ctx)
+	_, ownToken := values["access_token"]
+	usedToken := api.Token().Token
+
+	time, err = api.callWithRetry(ctx, path, values, parseInto, output)
+	if err != nil && !ownToken && IsUnauthorized(err) && api.refreshRejectedToken(ctx, usedToken) {
+		log.Println("Access token rejected, retrying", path, "with refreshed token")
+		values.Del("access_token")
+		time, err = api.callWithRetry(ctx, path, values, parseInto, output)
+	}
+	return
+}
+
+func (api *API) callWithRetry(ctx context.Context, path string, values url.Values, parseInto BasicResponse, output bool) (time int64, err error) {
+	if !idempotentPaths[path] {
+		return api.callAndParseInto(ctx, path, values, parseInto, output)
+	}
+	err = api.withRetry(ctx, path, func() (callErr error) {
+		time, callErr = api.callAndParseInto(ctx, path, values, parseInto, output)
+		return
+	})
+	return
+}
+
+func (api *API) callAndParseInto(ctx context.Context, path string, values url.Values, parseInto BasicResponse, output bool) (int64, error) {
 	startTime := time.Now()
-	response, err := api.PostWithToken(path, values)
+	response, err := api.PostWithTokenContext(ctx, path, values)
 	endTime := time.Now()
 	time := endTime.Sub(startTime).Nanoseconds() / 1000000
 	//log.Println("Call time: ", time)
 	if err != nil {
-		fmt.Println(err)
-		panic(err)
-		return time
+		return time, &APIError{Path: path, Err: err}
 	}
+	defer response.Body.Close()
 
 	jsonOutputter := json.NewEncoder(os.Stdout)
 
@@ -74,7 +137,7 @@ func (api *API) CallAndParseIntoWithOutput(path string, values url.Values, parse
 	if err != nil {
 		//fmt.Println(path, err)
 		//fmt.Println(path, "Could not parse reponse: ", string(buf.Bytes()))
-		return time
+		return time, &APIError{Path: path, HTTPStatus: response.StatusCode, Body: buf.String(), Err: err, RetryAfter: parseRetryAfter(response.Header)}
 	}
 
 	if output {
@@ -82,16 +145,20 @@ func (api *API) CallAndParseIntoWithOutput(path string, values url.Values, parse
 	}
 
 	if parseInto.GetStatus() != 20000 && parseInto.GetStatus() != 200 {
-		panic("Call failed")
+		return time, &APIError{Path: path, HTTPStatus: response.StatusCode, Status: parseInto.GetStatus(), Body: buf.String(), RetryAfter: parseRetryAfter(response.Header)}
 	}
 
-	return time
+	return time, nil
 }
 
-func (api *API) CallAndParseInto(path string, values url.Values, parseInto BasicResponse) int64 {
+func (api *API) CallAndParseInto(path string, values url.Values, parseInto BasicResponse) (int64, error) {
 	return api.CallAndParseIntoWithOutput(path, values, parseInto, false)
 }
 
+func (api *API) CallAndParseIntoContext(ctx context.Context, path string, values url.Values, parseInto BasicResponse) (int64, error) {
+	return api.CallAndParseIntoWithOutputContext(ctx, path, values, parseInto, false)
+}
+
 func (api *API) LoadClientCredentials(path string) error {
 	log.Println("Loading client credentials from:", path)
 
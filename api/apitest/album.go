@@ -0,0 +1,92 @@
+package apitest
+
+import (
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type album struct {
+	api.Album
+	MediaIds []string
+}
+
+// AlbumMedia returns the IDs of the media in the album called name, and
+// whether that album exists.
+func (s *Server) AlbumMedia(name string) (mediaIds []string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.albums {
+		if a.Name == name {
+			return append([]string{}, a.MediaIds...), true
+		}
+	}
+	return
+}
+
+func (s *Server) listAlbums(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	albums := []api.Album{}
+	for _, id := range s.albumOrder {
+		albums = append(albums, s.albums[id].Album)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": 20000, "albums": albums})
+}
+
+func (s *Server) createAlbum(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := r.FormValue("name")
+	if name == "" {
+		writeStatus(w, http.StatusBadRequest, 40000, "Album name is required")
+		return
+	}
+
+	a := &album{}
+	a.Id = s.newId("album")
+	a.Name = name
+	a.CreatedAt = time.Now().Unix()
+	a.UpdatedAt = a.CreatedAt
+	s.albums[a.Id] = a
+	s.albumOrder = append(s.albumOrder, a.Id)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": 20000, "album": a.Album})
+}
+
+func (s *Server) addMediaToAlbum(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.albums[r.FormValue("id")]
+	if !ok {
+		writeStatus(w, http.StatusNotFound, 40400, "Album not found")
+		return
+	}
+
+	for _, mediaId := range strings.Split(r.FormValue("media_ids"), ",") {
+		if _, ok := s.medias[mediaId]; !ok {
+			writeStatus(w, http.StatusNotFound, 40400, "Media not found")
+			return
+		}
+	}
+	for _, mediaId := range strings.Split(r.FormValue("media_ids"), ",") {
+		present := false
+		for _, existing := range a.MediaIds {
+			if existing == mediaId {
+				present = true
+				break
+			}
+		}
+		if !present {
+			a.MediaIds = append(a.MediaIds, mediaId)
+		}
+	}
+	a.MediaCount = len(a.MediaIds)
+	a.UpdatedAt = time.Now().Unix()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": 20000, "album": a.Album})
+}
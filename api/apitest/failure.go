@@ -0,0 +1,157 @@
+package apitest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Failure describes a fault injected into matching requests.
+type Failure struct {
+	// Path limits the failure to one endpoint ("medias/create", "ruler", ...).
+	// Blank matches every endpoint.
+	Path string
+	// Method limits the failure to one HTTP method. Blank matches any.
+	Method string
+	// Times is the number of matching requests to fail. Zero fails every
+	// matching request until ClearFailures is called.
+	Times int
+
+	// HTTPStatus and Status are the HTTP status and Picturelife status of the
+	// error response. HTTPStatus defaults to 500 and Status to HTTPStatus
+	// followed by two zeros.
+	HTTPStatus int
+	Status     int64
+	// RetryAfter, if set, is sent as a Retry-After header.
+	RetryAfter time.Duration
+	// RulerError, if set, is sent as an X-Ruler-Error header.
+	RulerError string
+	// Drop closes the connection without sending a response.
+	Drop bool
+	// Delay holds matching requests this long before answering them. A
+	// failure that sets nothing else is then handled as usual, which makes
+	// the request slow rather than failed.
+	Delay time.Duration
+
+	// DropAfterBytes makes a Ruler PUT keep this many bytes of the body and
+	// then close the connection, as if the link had failed mid-upload. A GET
+	// of an original sends this many bytes before closing the connection.
+	DropAfterBytes int64
+	// SignatureMismatch makes a Ruler PUT that completes the upload answer
+	// with status 519256, as if the bytes received did not match.
+	SignatureMismatch bool
+	// DiscardBytes makes a Ruler PUT answer as usual without storing any of
+	// the body.
+	DiscardBytes bool
+	// OmitRulerSize leaves the X-Ruler-Size header out of Ruler responses.
+	OmitRulerSize bool
+}
+
+type failureKey struct{}
+
+// Fail injects f into the server. Failures are matched in the order they
+// were added.
+func (s *Server) Fail(f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &f)
+}
+
+// ClearFailures removes every injected failure.
+func (s *Server) ClearFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = nil
+}
+
+// matchFailure returns the first failure matching the request and uses up one
+// of its Times. The caller must hold s.mu.
+func (s *Server) matchFailure(method, path string) *Failure {
+	for i, f := range s.failures {
+		if (f.Path != "" && f.Path != path) || (f.Method != "" && f.Method != method) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		matched := *f
+		return &matched
+	}
+	return nil
+}
+
+// changesUpload reports whether f alters how a Ruler request is processed
+// rather than replacing the response. Such failures are handed to the handler
+// in the request context.
+func (f *Failure) changesUpload() bool {
+	return f.DropAfterBytes > 0 || f.SignatureMismatch || f.DiscardBytes || f.OmitRulerSize || f.onlyDelays()
+}
+
+// onlyDelays reports whether f slows requests down without failing them.
+func (f *Failure) onlyDelays() bool {
+	slow := *f
+	slow.Path, slow.Method, slow.Times, slow.Delay = "", "", 0, 0
+	return f.Delay > 0 && slow == Failure{}
+}
+
+// rulerSize sets the X-Ruler-Size header unless f leaves it out.
+func (f *Failure) rulerSize(w http.ResponseWriter, size int64) {
+	if f != nil && f.OmitRulerSize {
+		return
+	}
+	w.Header().Set("X-Ruler-Size", strconv.FormatInt(size, 10))
+}
+
+func (f *Failure) withRequest(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), failureKey{}, f))
+}
+
+// respond answers the request with the failure.
+func (f *Failure) respond(w http.ResponseWriter, r *http.Request) {
+	if f.Drop {
+		dropConnection(w)
+		return
+	}
+
+	httpStatus := f.HTTPStatus
+	if httpStatus == 0 {
+		httpStatus = http.StatusInternalServerError
+	}
+	status := f.Status
+	if status == 0 {
+		status = int64(httpStatus) * 100
+	}
+	if f.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(f.RetryAfter.Seconds())))
+	}
+	if f.RulerError != "" {
+		w.Header().Set("X-Ruler-Error", f.RulerError)
+	}
+	if r.Method == "HEAD" {
+		w.WriteHeader(httpStatus)
+		return
+	}
+	writeStatus(w, httpStatus, status, "Injected failure")
+}
+
+func requestFailure(r *http.Request) *Failure {
+	f, _ := r.Context().Value(failureKey{}).(*Failure)
+	return f
+}
+
+func dropConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic("apitest: response writer cannot be hijacked")
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
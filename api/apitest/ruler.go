@@ -0,0 +1,232 @@
+package apitest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type upload struct {
+	Signature string
+	Filename  string
+	Data      []byte
+	Complete  bool
+	Location  string
+}
+
+// UploadedBytes returns how many bytes Ruler holds for signature.
+func (s *Server) UploadedBytes(signature string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.uploads[signature]; ok {
+		return int64(len(u.Data))
+	}
+	return 0
+}
+
+// UploadDeletes returns how many times the upload of signature was deleted
+// from Ruler.
+func (s *Server) UploadDeletes(signature string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deletes[signature]
+}
+
+func (s *Server) ruler(w http.ResponseWriter, r *http.Request) {
+	if !s.validToken(r.FormValue("access_token")) {
+		w.Header().Set("X-Ruler-Error", "Invalid access token")
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeStatus(w, http.StatusUnauthorized, 40100, "Invalid access token")
+		return
+	}
+
+	switch r.Method {
+	case "HEAD":
+		s.rulerHead(w, r)
+	case "PUT":
+		s.rulerPut(w, r)
+	case "DELETE":
+		s.rulerDelete(w, r)
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, 40500, "Method not allowed")
+	}
+}
+
+func (s *Server) rulerHead(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var size int64
+	if u, ok := s.uploads[r.FormValue("signature")]; ok {
+		size = int64(len(u.Data))
+	}
+	requestFailure(r).rulerSize(w, size)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) rulerDelete(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.uploads, r.FormValue("signature"))
+	s.deletes[r.FormValue("signature")]++
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": 200})
+}
+
+// rulerPut appends the body to the upload. Without a Content-Range header the
+// body is the whole file; with one, it must start where the stored bytes end.
+// Bytes received before a dropped connection are kept so the upload can be
+// resumed.
+func (s *Server) rulerPut(w http.ResponseWriter, r *http.Request) {
+	sig := r.FormValue("signature")
+	failure := requestFailure(r)
+
+	var start, total int64 = 0, r.ContentLength
+	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+		// As with the real Ruler, the end is the offset after the last byte
+		// sent rather than the last byte itself
+		var end int64
+		_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total)
+		if err != nil || end-start != r.ContentLength || end > total {
+			writeStatus(w, http.StatusBadRequest, 40000, "Invalid Content-Range")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	u, ok := s.uploads[sig]
+	if !ok || start == 0 {
+		u = &upload{Signature: sig, Filename: r.FormValue("filename")}
+		s.uploads[sig] = u
+	}
+	if int64(len(u.Data)) != start {
+		size := int64(len(u.Data))
+		s.mu.Unlock()
+		failure.rulerSize(w, size)
+		writeStatus(w, http.StatusRequestedRangeNotSatisfiable, 41600, "Content-Range does not start at the uploaded size")
+		return
+	}
+	s.mu.Unlock()
+
+	var body io.Reader = r.Body
+	if failure != nil && failure.DropAfterBytes > 0 {
+		body = io.LimitReader(r.Body, failure.DropAfterBytes)
+	}
+	received, _ := io.ReadAll(body)
+	if failure != nil && failure.DiscardBytes {
+		received = nil
+	}
+
+	s.mu.Lock()
+	u.Data = append(u.Data, received...)
+	size := int64(len(u.Data))
+	s.mu.Unlock()
+
+	if failure != nil && failure.DropAfterBytes > 0 {
+		dropConnection(w)
+		return
+	}
+
+	if total < 0 {
+		total = size
+	}
+	failure.rulerSize(w, size)
+	if size < total {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"status": 202})
+		return
+	}
+
+	hash := sha256.Sum256(u.Data)
+	calculated := hex.EncodeToString(hash[:])
+	if calculated != sig || (failure != nil && failure.SignatureMismatch) {
+		s.mu.Lock()
+		delete(s.uploads, sig)
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":    519256,
+			"error":     "Ruler calculated different signature",
+			"signature": calculated,
+		})
+		return
+	}
+
+	s.mu.Lock()
+	u.Complete = true
+	u.Location = fmt.Sprintf("%s/originals/%s%s", s.URL, sig, filepath.Ext(u.Filename))
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    200,
+		"location":  u.Location,
+		"signature": calculated,
+	})
+}
+
+// original serves the uploaded bytes of a media at its location, with support
+// for ranged GETs.
+func (s *Server) original(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/originals/")
+	sig := strings.TrimSuffix(name, filepath.Ext(name))
+
+	s.mu.Lock()
+	u, ok := s.uploads[sig]
+	var data []byte
+	if ok && u.Complete {
+		data = u.Data
+	}
+	s.mu.Unlock()
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if failure := requestFailure(r); failure != nil && failure.DropAfterBytes > 0 {
+		dropAfterBody(w, r, data, failure.DropAfterBytes)
+		return
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// dropAfterBody answers a GET for data with at most n bytes of the requested
+// range and then closes the connection.
+func dropAfterBody(w http.ResponseWriter, r *http.Request, data []byte, n int64) {
+	var start int64
+	status := "200 OK"
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		fmt.Sscanf(rangeHeader, "bytes=%d-", &start)
+		status = "206 Partial Content"
+	}
+	if start > int64(len(data)) {
+		start = int64(len(data))
+	}
+	end := start + n
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic("apitest: response writer cannot be hijacked")
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(buf, "HTTP/1.1 %s\r\nContent-Length: %d\r\n", status, int64(len(data))-start)
+	if start > 0 {
+		fmt.Fprintf(buf, "Content-Range: bytes %d-%d/%d\r\n", start, len(data)-1, len(data))
+	}
+	buf.WriteString("\r\n")
+	buf.Write(data[start:end])
+	buf.Flush()
+	conn.Close()
+}
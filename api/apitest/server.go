@@ -0,0 +1,572 @@
+// Package apitest provides an in-process fake of the Picturelife API and the
+// Ruler upload service, for tests and for running the uploader offline.
+//
+// A Server answers oauth/authorize, oauth/access_token, oauth/check_token,
+// medias/check_signatures, medias/create, medias/show, medias/index,
+// pending_medias/show, albums/index, albums/create, albums/add_media and the
+// Ruler HEAD/PUT/DELETE protocol on a single
+// httptest server, and serves uploaded originals at their media URL. Failures
+// can be injected with Fail.
+package apitest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type token struct {
+	Token        string
+	RefreshToken string
+	Email        string
+	ExpiresAt    time.Time
+	Revoked      bool
+}
+
+type media struct {
+	api.Media
+	Signature string
+	Location  string
+	PendingId string
+	ProcessAt time.Time
+	Failed    bool
+	ErrorData []interface{}
+	Tags      []string
+}
+
+type Server struct {
+	*httptest.Server
+
+	// Email and Password are the credentials accepted by the password grant.
+	Email    string
+	Password string
+	// ClientId and ClientSecret, when set, must match the client credentials
+	// sent with token requests. When blank any client is accepted.
+	ClientId     string
+	ClientSecret string
+	// TokenLifetime is how long issued access tokens stay valid.
+	TokenLifetime time.Duration
+	// ProcessingDelay is how long new media stay pending before processing
+	// completes on its own.
+	ProcessingDelay time.Duration
+	// DenyAuthorization makes oauth/authorize redirect with an access_denied
+	// error instead of a code, as if the user declined.
+	DenyAuthorization bool
+
+	mu            sync.Mutex
+	tokens        map[string]*token
+	refreshTokens map[string]*token
+	codes         map[string]*authCode
+	medias        map[string]*media // by media ID
+	mediaOrder    []string          // media IDs in creation order
+	signatures    map[string]*media // by signature
+	pending       map[string]*media // by pending media ID
+	uploads       map[string]*upload
+	deletes       map[string]int    // Ruler DELETEs by signature
+	albums        map[string]*album // by album ID
+	albumOrder    []string          // album IDs in creation order
+	failures      []*Failure
+	calls         map[string]int
+	nextId        int
+}
+
+// NewServer starts a fake server. The caller must Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		Email:           "test@example.com",
+		Password:        "password",
+		TokenLifetime:   time.Hour,
+		ProcessingDelay: 2 * time.Second,
+		tokens:          make(map[string]*token),
+		refreshTokens:   make(map[string]*token),
+		codes:           make(map[string]*authCode),
+		medias:          make(map[string]*media),
+		signatures:      make(map[string]*media),
+		pending:         make(map[string]*media),
+		uploads:         make(map[string]*upload),
+		deletes:         make(map[string]int),
+		albums:          make(map[string]*album),
+		calls:           make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/authorize", s.handle("oauth/authorize", s.authorize))
+	mux.HandleFunc("/oauth/access_token", s.handle("oauth/access_token", s.accessToken))
+	mux.HandleFunc("/oauth/check_token", s.handle("oauth/check_token", s.checkToken))
+	mux.HandleFunc("/medias/check_signatures", s.handle("medias/check_signatures", s.authorized(s.checkSignatures)))
+	mux.HandleFunc("/medias/create", s.handle("medias/create", s.authorized(s.createMedia)))
+	mux.HandleFunc("/medias/show", s.handle("medias/show", s.authorized(s.showMedia)))
+	mux.HandleFunc("/medias/index", s.handle("medias/index", s.authorized(s.listMedia)))
+	mux.HandleFunc("/pending_medias/show", s.handle("pending_medias/show", s.authorized(s.showPendingMedia)))
+	mux.HandleFunc("/albums/index", s.handle("albums/index", s.authorized(s.listAlbums)))
+	mux.HandleFunc("/albums/create", s.handle("albums/create", s.authorized(s.createAlbum)))
+	mux.HandleFunc("/albums/add_media", s.handle("albums/add_media", s.authorized(s.addMediaToAlbum)))
+	mux.HandleFunc("/ruler", s.handle("ruler", s.ruler))
+	mux.HandleFunc("/originals/", s.handle("originals", s.original))
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Configure points a at the fake server for both the API and Ruler.
+func (s *Server) Configure(a *api.API) {
+	a.Host = s.URL
+	a.ServicesHost = s.URL
+	a.Port = ""
+	a.ServicesPort = ""
+}
+
+// Calls returns how many requests were made to path ("medias/create",
+// "ruler", ...), including ones answered by an injected failure.
+func (s *Server) Calls(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[path]
+}
+
+// IssueToken creates a valid access token without a login.
+func (s *Server) IssueToken() api.AccessToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issueToken(s.Email)
+}
+
+// ExpireToken makes accessToken expired, as if its lifetime had run out.
+func (s *Server) ExpireToken(accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tokens[accessToken]; ok {
+		t.ExpiresAt = time.Now().Add(-time.Second)
+	}
+}
+
+// RevokeTokens invalidates every access and refresh token issued so far.
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		t.Revoked = true
+	}
+}
+
+// AddMedia records a media for signature as if it had been uploaded earlier
+// and returns its ID.
+func (s *Server) AddMedia(signature string, deleted bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.newMedia(signature, "")
+	m.Processed = true
+	m.Deleted = deleted
+	return m.Id
+}
+
+// MediaTags returns the tags sent when the media for signature was created.
+func (s *Server) MediaTags(signature string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.signatures[signature]; ok {
+		return append([]string{}, m.Tags...)
+	}
+	return nil
+}
+
+// DeleteMedia marks the media with the given signature as deleted.
+func (s *Server) DeleteMedia(signature string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.signatures[signature]; ok {
+		m.Deleted = true
+	}
+}
+
+// Media returns the media stored for signature.
+func (s *Server) Media(signature string) (m api.Media, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.signatures[signature]
+	if ok {
+		m = stored.Media
+	}
+	return
+}
+
+func (s *Server) newId(prefix string) string {
+	s.nextId++
+	return fmt.Sprintf("%s%d", prefix, s.nextId)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *Server) issueToken(email string) api.AccessToken {
+	t := &token{
+		Token:        randomString(),
+		RefreshToken: randomString(),
+		Email:        email,
+		ExpiresAt:    time.Now().Add(s.TokenLifetime),
+	}
+	s.tokens[t.Token] = t
+	s.refreshTokens[t.RefreshToken] = t
+	return api.AccessToken{
+		Token:        t.Token,
+		UserId:       "user1",
+		RefreshToken: t.RefreshToken,
+		Expires:      float64(t.ExpiresAt.Unix()),
+		Email:        email,
+	}
+}
+
+func (s *Server) newMedia(signature, location string) *media {
+	m := &media{Signature: signature, Location: location}
+	m.Media.Signature = signature
+	m.Id = s.newId("media")
+	m.User_Id = "user1"
+	m.Visible = true
+	m.Created_At = int(time.Now().Unix())
+	m.Updated_At = m.Created_At
+	m.Url = location
+	m.Media_Type = "photo"
+	m.Format = strings.ToLower(strings.TrimPrefix(filepath.Ext(location), "."))
+	s.medias[m.Id] = m
+	s.mediaOrder = append(s.mediaOrder, m.Id)
+	s.signatures[signature] = m
+	return m
+}
+
+// handle counts calls to path and answers them with an injected failure if
+// one matches.
+func (s *Server) handle(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.calls[path]++
+		failure := s.matchFailure(r.Method, path)
+		s.mu.Unlock()
+
+		log.Println("FAKE API", r.Method, path)
+
+		if failure != nil {
+			if failure.Delay > 0 {
+				time.Sleep(failure.Delay)
+			}
+			if !failure.changesUpload() {
+				failure.respond(w, r)
+				return
+			}
+			r = failure.withRequest(r)
+		}
+		next(w, r)
+	}
+}
+
+// authorized rejects requests whose access_token is unknown, expired or
+// revoked.
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.validToken(r.FormValue("access_token")) {
+			writeStatus(w, http.StatusUnauthorized, 40100, "Invalid access token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) validToken(accessToken string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[accessToken]
+	return ok && !t.Revoked && time.Now().Before(t.ExpiresAt)
+}
+
+func writeJSON(w http.ResponseWriter, httpStatus int, body map[string]interface{}) {
+	if _, ok := body["response_time"]; !ok {
+		body["response_time"] = 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeStatus(w http.ResponseWriter, httpStatus int, status int64, message string) {
+	writeJSON(w, httpStatus, map[string]interface{}{"status": status, "error": message})
+}
+
+func (s *Server) accessToken(w http.ResponseWriter, r *http.Request) {
+	if s.ClientId != "" && (r.FormValue("client_id") != s.ClientId || r.FormValue("client_secret") != s.ClientSecret) {
+		writeStatus(w, http.StatusUnauthorized, 40100, "Invalid client credentials")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var issued api.AccessToken
+	switch r.FormValue("grant_type") {
+	case "password":
+		if r.FormValue("email") != s.Email || r.FormValue("password") != s.Password {
+			writeStatus(w, http.StatusUnauthorized, 40100, "Invalid email or password")
+			return
+		}
+		issued = s.issueToken(s.Email)
+	case "authorization_code":
+		code, ok := s.codes[r.FormValue("code")]
+		if !ok || code.RedirectURI != r.FormValue("redirect_uri") {
+			writeStatus(w, http.StatusUnauthorized, 40100, "Invalid authorization code")
+			return
+		}
+		// Codes can only be used once, even with the wrong verifier
+		delete(s.codes, r.FormValue("code"))
+		if api.CodeChallenge(r.FormValue("code_verifier")) != code.CodeChallenge {
+			writeStatus(w, http.StatusUnauthorized, 40100, "Invalid code verifier")
+			return
+		}
+		issued = s.issueToken(code.Email)
+	case "refresh_token":
+		old, ok := s.refreshTokens[r.FormValue("refresh_token")]
+		if !ok || old.Revoked {
+			writeStatus(w, http.StatusUnauthorized, 40100, "Invalid refresh token")
+			return
+		}
+		delete(s.refreshTokens, old.RefreshToken)
+		old.Revoked = true
+		issued = s.issueToken(old.Email)
+	default:
+		writeStatus(w, http.StatusBadRequest, 40000, "Unsupported grant type")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":       20000,
+		"Token":        issued.Token,
+		"UserId":       issued.UserId,
+		"RefreshToken": issued.RefreshToken,
+		"Expires":      issued.Expires,
+		"Email":        issued.Email,
+	})
+}
+
+// authCode is an authorization code waiting to be exchanged for tokens.
+type authCode struct {
+	Email         string
+	RedirectURI   string
+	CodeChallenge string // S256 PKCE challenge the code must be exchanged with
+}
+
+// authorize approves every request straight away, as if the user had logged
+// in as Email, and redirects to redirect_uri with a code.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	if s.ClientId != "" && r.FormValue("client_id") != s.ClientId {
+		writeStatus(w, http.StatusUnauthorized, 40100, "Invalid client credentials")
+		return
+	}
+	redirectURI := r.FormValue("redirect_uri")
+	// Native apps must use PKCE (RFC 8252)
+	challenge := r.FormValue("code_challenge")
+	if r.FormValue("response_type") != "code" || redirectURI == "" || challenge == "" || r.FormValue("code_challenge_method") != "S256" {
+		writeStatus(w, http.StatusBadRequest, 40000, "Invalid authorization request")
+		return
+	}
+
+	params := url.Values{}
+	params.Add("state", r.FormValue("state"))
+	s.mu.Lock()
+	if s.DenyAuthorization {
+		params.Add("error", "access_denied")
+	} else {
+		code := randomString()
+		s.codes[code] = &authCode{Email: s.Email, RedirectURI: redirectURI, CodeChallenge: challenge}
+		params.Add("code", code)
+	}
+	s.mu.Unlock()
+	http.Redirect(w, r, redirectURI+"?"+params.Encode(), http.StatusFound)
+}
+
+func (s *Server) checkToken(w http.ResponseWriter, r *http.Request) {
+	// The knobs change tokens in place, so they are read under the lock
+	s.mu.Lock()
+	var revoked bool
+	var expiresAt time.Time
+	t, ok := s.tokens[r.FormValue("access_token")]
+	if ok {
+		revoked, expiresAt = t.Revoked, t.ExpiresAt
+	}
+	s.mu.Unlock()
+	if !ok || revoked {
+		writeStatus(w, http.StatusUnauthorized, 40100, "Invalid access token")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": 20000,
+		"TokenStatus": map[string]interface{}{
+			"Expired":    time.Now().After(expiresAt),
+			"ExpireTime": int(time.Until(expiresAt).Seconds()),
+			"TokenType":  "bearer",
+		},
+	})
+}
+
+func (s *Server) checkSignatures(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	signatures := map[string]api.SignatureResponse{}
+	for _, sig := range strings.Split(r.FormValue("signatures"), ",") {
+		if m, ok := s.signatures[sig]; ok {
+			signatures[sig] = api.SignatureResponse{MediaId: m.Id, Deleted: m.Deleted, Count: 1}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": 20000, "Signatures": signatures})
+}
+
+func (s *Server) createMedia(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sig := r.FormValue("signature")
+	force := r.FormValue("force") == "true"
+
+	if existing, ok := s.signatures[sig]; ok && (!existing.Deleted || !force) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": 20000, "media": existing.Media})
+		return
+	}
+
+	u, ok := s.uploads[sig]
+	if !ok || !u.Complete || u.Location != r.FormValue("url") {
+		writeStatus(w, http.StatusBadRequest, 40000, "No completed upload at url")
+		return
+	}
+
+	m := s.newMedia(sig, u.Location)
+	m.Caption = r.FormValue("caption")
+	m.Tags = r.Form["tags[]"]
+	m.PendingId = s.newId("pending")
+	m.ProcessAt = time.Now().Add(s.ProcessingDelay)
+	s.pending[m.PendingId] = m
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        20000,
+		"pending_media": pendingMedia(m),
+	})
+}
+
+func pendingMedia(m *media) api.PendingMedia {
+	p := api.PendingMedia{
+		Id:                 m.PendingId,
+		CreatedAt:          int64(m.Created_At),
+		UpdatedAt:          int64(m.Updated_At),
+		MediaType:          "photo",
+		ProcessingComplete: m.Processed || m.Failed,
+		Status:             "uploaded",
+		UploadComplete:     true,
+		UserId:             m.User_Id,
+		Error:              m.Failed,
+		ErrorData:          m.ErrorData,
+	}
+	if m.Processed {
+		p.MediaId = m.Id
+		p.Status = "processed"
+	}
+	if m.Failed {
+		p.Status = "failed"
+	}
+	return p
+}
+
+// CompleteProcessing finishes processing of the pending media for signature
+// straight away.
+func (s *Server) CompleteProcessing(signature string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.signatures[signature]; ok && !m.Failed {
+		m.Processed = true
+	}
+}
+
+// FailProcessing makes processing of the pending media for signature fail
+// with errorData. The server forgets the media, as it does when processing
+// fails.
+func (s *Server) FailProcessing(signature string, errorData ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.signatures[signature]; ok && !m.Processed {
+		m.Failed = true
+		m.ErrorData = errorData
+		delete(s.signatures, signature)
+		delete(s.medias, m.Id)
+	}
+}
+
+func (s *Server) showPendingMedia(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.pending[r.FormValue("id")]
+	if !ok {
+		writeStatus(w, http.StatusNotFound, 40400, "Pending media not found")
+		return
+	}
+	if !m.Processed && !m.Failed && !time.Now().Before(m.ProcessAt) {
+		m.Processed = true
+	}
+
+	body := map[string]interface{}{"status": 20000, "pending_media": pendingMedia(m)}
+	if m.Processed {
+		body["media"] = m.Media
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (s *Server) showMedia(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.medias[r.FormValue("id")]
+	if !ok {
+		writeStatus(w, http.StatusNotFound, 40400, "Media not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": 20000, "media": m.Media})
+}
+
+func (s *Server) listMedia(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	all := []api.Media{}
+	for _, id := range s.mediaOrder {
+		if m, ok := s.medias[id]; ok {
+			all = append(all, m.Media)
+		}
+	}
+	page := []api.Media{}
+	if offset < len(all) {
+		end := offset + limit
+		if end > len(all) {
+			end = len(all)
+		}
+		page = all[offset:end]
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": 20000, "media": page, "total": len(all)})
+}
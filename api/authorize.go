@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// authorizeTimeout is how long LoginWithBrowser waits for the user to approve
+// the uploader.
+const authorizeTimeout = 5 * time.Minute
+
+const authorizedPage = `<html><body><p>You are logged in to the Picturelife uploader. You can close this window.</p></body></html>`
+
+// NewCodeVerifier returns a random PKCE code verifier (RFC 7636). It is kept
+// by the uploader, and only its challenge is sent with the authorize request,
+// so that a code intercepted on its way to the loopback listener cannot be
+// exchanged by anyone else.
+func NewCodeVerifier() (string, error) {
+	verifier := make([]byte, 32)
+	if _, err := rand.Read(verifier); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(verifier), nil
+}
+
+// CodeChallenge returns the S256 PKCE code challenge of verifier.
+func CodeChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// AuthorizeURL returns the Picturelife page where the user approves the
+// uploader. Picturelife then redirects to redirectURI with a code and the
+// given state. codeChallenge is the CodeChallenge of the verifier the code
+// will be exchanged with.
+func (api *API) AuthorizeURL(redirectURI, state, codeChallenge string) string {
+	params := url.Values{}
+	params.Add("client_id", api.ClientId)
+	params.Add("response_type", "code")
+	params.Add("redirect_uri", redirectURI)
+	params.Add("state", state)
+	params.Add("code_challenge", codeChallenge)
+	params.Add("code_challenge_method", "S256")
+	return api.MakeFullPath("oauth/authorize") + "?" + params.Encode()
+}
+
+// ExchangeCodeContext exchanges an authorization code for tokens. redirectURI
+// must be the one the code was issued for, and codeVerifier the verifier
+// whose challenge was sent with it.
+func (api *API) ExchangeCodeContext(ctx context.Context, code, redirectURI, codeVerifier string) (token AccessToken, err error) {
+	path := "oauth/access_token"
+
+	params := url.Values{}
+	params.Add("code", code)
+	params.Add("redirect_uri", redirectURI)
+	params.Add("code_verifier", codeVerifier)
+	params.Add("grant_type", "authorization_code")
+	params.Add("client_id", api.ClientId)
+	params.Add("client_secret", api.ClientSecret)
+	params.Add("client_uuid", "Open source install")
+
+	var loginResponse LoginResponse
+	_, err = api.CallAndParseIntoWithOutputContext(ctx, path, params, &loginResponse, false)
+	if err != nil {
+		log.Println("Login failed because call failed:", err)
+		return
+	}
+
+	if loginResponse.Token == "" {
+		err = errors.New("Login response did not contain an access token.")
+		return
+	}
+	token = newAccessToken(loginResponse)
+	return
+}
+
+type authorizeResult struct {
+	code string
+	err  error
+}
+
+// LoginWithBrowser logs in with the OAuth authorization code grant, so that
+// the password is only ever typed into Picturelife itself. It listens for the
+// redirect on a loopback port, calls open with the authorize URL, and
+// exchanges the code it receives for tokens. It gives up after five minutes or
+// when ctx is done.
+func (api *API) LoginWithBrowser(ctx context.Context, open func(url string) error) (token AccessToken, err error) {
+	ctx, cancel := context.WithTimeout(ctx, authorizeTimeout)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	redirectURI := fmt.Sprintf("http://%s/callback", listener.Addr())
+
+	stateBytes := make([]byte, 16)
+	if _, err = rand.Read(stateBytes); err != nil {
+		listener.Close()
+		return
+	}
+	state := hex.EncodeToString(stateBytes)
+	codeVerifier, err := NewCodeVerifier()
+	if err != nil {
+		listener.Close()
+		return
+	}
+
+	results := make(chan authorizeResult, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callback" {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		// A redirect without our state did not come from this login
+		if query.Get("state") != state {
+			http.Error(w, "Unexpected login callback.", http.StatusBadRequest)
+			return
+		}
+		var result authorizeResult
+		if query.Get("error") != "" {
+			result.err = fmt.Errorf("Login was not approved: %s", query.Get("error"))
+			http.Error(w, "Login was not approved. You can close this window.", http.StatusForbidden)
+		} else if query.Get("code") == "" {
+			result.err = errors.New("Login callback did not contain a code.")
+			http.Error(w, "Login failed. You can close this window.", http.StatusBadRequest)
+		} else {
+			result.code = query.Get("code")
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, authorizedPage)
+		}
+		select {
+		case results <- result:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	err = open(api.AuthorizeURL(redirectURI, state, CodeChallenge(codeVerifier)))
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		if err == context.DeadlineExceeded {
+			err = errors.New("Timed out waiting for the login to be approved in the browser.")
+		}
+		return
+	case result := <-results:
+		if result.err != nil {
+			err = result.err
+			return
+		}
+		return api.ExchangeCodeContext(ctx, result.code, redirectURI, codeVerifier)
+	}
+}
@@ -0,0 +1,88 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+)
+
+func TestCodeChallenge(t *testing.T) {
+	// The example from RFC 7636, appendix B
+	challenge := api.CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("CodeChallenge returned %s", challenge)
+	}
+}
+
+func TestLoginWithBrowser(t *testing.T) {
+	s, a := newFakeAPI(t)
+	a.SetToken(api.AccessToken{})
+
+	token, err := a.LoginWithBrowser(context.Background(), func(authorizeURL string) error {
+		// Following the redirect delivers the code to the callback
+		resp, err := http.Get(authorizeURL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token == "" || token.Email != s.Email {
+		t.Errorf("logged in with %+v", token)
+	}
+}
+
+// authorizeCode requests a code for redirectURI with challenge, without
+// following the redirect.
+func authorizeCode(t *testing.T, a *api.API, redirectURI, challenge string) (code string, status int) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(a.AuthorizeURL(redirectURI, "state", challenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("code"), resp.StatusCode
+}
+
+func TestExchangeCodeNeedsVerifier(t *testing.T) {
+	_, a := newFakeAPI(t)
+	redirectURI := "http://127.0.0.1:1/callback"
+	verifier, err := api.NewCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := authorizeCode(t, a, redirectURI, api.CodeChallenge(verifier))
+	other, _ := api.NewCodeVerifier()
+	if _, err := a.ExchangeCodeContext(context.Background(), code, redirectURI, other); !api.IsUnauthorized(err) {
+		t.Errorf("exchange with the wrong verifier returned %v", err)
+	}
+	// The code was used up by the failed exchange
+	if _, err := a.ExchangeCodeContext(context.Background(), code, redirectURI, verifier); err == nil {
+		t.Error("code could be exchanged twice")
+	}
+
+	code, _ = authorizeCode(t, a, redirectURI, api.CodeChallenge(verifier))
+	if _, err := a.ExchangeCodeContext(context.Background(), code, redirectURI, verifier); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthorizeNeedsChallenge(t *testing.T) {
+	_, a := newFakeAPI(t)
+	if _, status := authorizeCode(t, a, "http://127.0.0.1:1/callback", ""); status != http.StatusBadRequest {
+		t.Errorf("authorize without a challenge returned HTTP %d", status)
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxLimitedRead caps the size of a single read through a rate limited
+// reader so that one read cannot take a large share of the bucket at once.
+const maxLimitedRead = 32 * 1024
+
+// BandwidthLimiter is a token bucket limiting the combined rate of every
+// upload it is attached to. It can be shared by several API values and its
+// rate can be changed while uploads are running.
+type BandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   int64 // bytes per second, 0 for no limit
+	tokens float64
+	last   time.Time
+}
+
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	return &BandwidthLimiter{rate: bytesPerSecond, last: time.Now()}
+}
+
+// SetRate changes the limit. Zero removes it.
+func (l *BandwidthLimiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = bytesPerSecond
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+func (l *BandwidthLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// wait takes n bytes from the bucket, blocking until the bucket has refilled
+// enough to cover them.
+func (l *BandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	burst := float64(l.rate)
+	if burst < maxLimitedRead {
+		burst = maxLimitedRead
+	}
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// reader wraps r so that reads from it are limited by l. A nil limiter
+// returns r unchanged.
+func (l *BandwidthLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *BandwidthLimiter
+}
+
+func (lr *limitedReader) Read(b []byte) (n int, err error) {
+	if len(b) > maxLimitedRead {
+		b = b[:maxLimitedRead]
+	}
+	n, err = lr.r.Read(b)
+	if n > 0 {
+		if waitErr := lr.limiter.wait(lr.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return
+}
+
+// SetBandwidthLimiter makes every Ruler upload through api share limiter.
+func (api *API) SetBandwidthLimiter(limiter *BandwidthLimiter) {
+	api.bandwidthLimiter = limiter
+}
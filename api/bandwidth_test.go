@@ -0,0 +1,77 @@
+package api_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+)
+
+// timedUpload uploads a new file of size bytes and returns how long it took.
+func timedUpload(t *testing.T, ctx context.Context, a *api.API, size int) (time.Duration, error) {
+	t.Helper()
+	path, sig := writeMedia(t, size)
+	started := time.Now()
+	_, _, _, err := a.UploadContext(ctx, path, sig)
+	return time.Since(started), err
+}
+
+func TestBandwidthLimiterSlowsUpload(t *testing.T) {
+	_, a := newFakeAPI(t)
+	a.SetBandwidthLimiter(api.NewBandwidthLimiter(128 * 1024))
+
+	elapsed, err := timedUpload(t, context.Background(), a, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("64KB at 128KB/s took %s", elapsed)
+	}
+}
+
+func TestBandwidthLimiterSetRate(t *testing.T) {
+	_, a := newFakeAPI(t)
+	limiter := api.NewBandwidthLimiter(1024)
+	a.SetBandwidthLimiter(limiter)
+
+	limiter.SetRate(0)
+	if limiter.Rate() != 0 {
+		t.Errorf("rate is %d, want 0", limiter.Rate())
+	}
+	// At the old rate this would take more than a minute
+	elapsed, err := timedUpload(t, context.Background(), a, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("unlimited upload took %s", elapsed)
+	}
+
+	limiter.SetRate(128 * 1024)
+	if limiter.Rate() != 128*1024 {
+		t.Errorf("rate is %d, want %d", limiter.Rate(), 128*1024)
+	}
+	elapsed, err = timedUpload(t, context.Background(), a, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("64KB at 128KB/s took %s", elapsed)
+	}
+}
+
+func TestBandwidthLimitedUploadCanBeCancelled(t *testing.T) {
+	_, a := newFakeAPI(t)
+	a.SetBandwidthLimiter(api.NewBandwidthLimiter(1024))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	elapsed, err := timedUpload(t, ctx, a, 64*1024)
+	if err == nil {
+		t.Fatal("upload finished despite the cancelled context")
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("cancelled upload took %s to return", elapsed)
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// DownloadOriginal downloads the original file of media to destPath. Bytes
+// already in destPath are kept and only the rest is requested with a ranged
+// GET, so an interrupted download resumes where it stopped. The caller is
+// expected to check the signature of the finished file.
+func (api *API) DownloadOriginal(ctx context.Context, media Media, destPath string) error {
+	if media.Url == "" {
+		return &APIError{Path: "download", Err: errors.New("Media has no URL.")}
+	}
+	return api.withRetry(ctx, "Download", func() error {
+		return api.downloadRemaining(ctx, media.Url, destPath)
+	})
+}
+
+// downloadRemaining fetches the bytes of url that are not yet in destPath and
+// appends them. A server that ignores the Range header gets the file written
+// from the start.
+func (api *API) downloadRemaining(ctx context.Context, url, destPath string) error {
+	file, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return &APIError{Path: "download", Err: err}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := api.do(req)
+	if err != nil {
+		return &APIError{Path: "download", Err: err}
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Everything has been downloaded already
+		return nil
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if offset > 0 {
+			if err = file.Truncate(0); err != nil {
+				return err
+			}
+			if _, err = file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	default:
+		return &APIError{Path: "download", HTTPStatus: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header)}
+	}
+
+	_, err = io.Copy(file, resp.Body)
+	if err != nil {
+		return &APIError{Path: "download", Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// EndpointProfile describes one Picturelife deployment the uploader can talk
+// to.
+type EndpointProfile struct {
+	Host         string // API base URL, e.g. https://api.picturelife.com
+	ServicesHost string // Ruler base URL
+	Port         string // optional API port
+	ServicesPort string // optional Ruler port
+	// ClientFile, if set, is the client credentials file used with this
+	// profile unless -clientfile is given.
+	ClientFile string
+}
+
+// DefaultEndpointProfiles returns the built-in profiles. A profiles file can
+// override them or add more.
+func DefaultEndpointProfiles() map[string]EndpointProfile {
+	return map[string]EndpointProfile{
+		"production": {
+			Host:         "https://api.picturelife.com",
+			ServicesHost: "https://services.picturelife.com",
+		},
+		"staging": {
+			Host:         "https://api-staging.picturelife.com",
+			ServicesHost: "https://services-staging.picturelife.com",
+		},
+		"development": {
+			Host:         "http://localhost",
+			ServicesHost: "http://localhost",
+			Port:         "3000",
+			ServicesPort: "3001",
+		},
+	}
+}
+
+// LoadEndpointProfiles reads a JSON object of named profiles on top of the
+// built-in ones. A missing file leaves just the built-in profiles.
+func LoadEndpointProfiles(path string) (profiles map[string]EndpointProfile, err error) {
+	profiles = DefaultEndpointProfiles()
+
+	log.Println("Loading endpoint profiles from:", path)
+
+	file, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Println("No endpoint profiles file found, using built-in profiles.")
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	var loaded map[string]EndpointProfile
+	err = json.Unmarshal(file, &loaded)
+	if err != nil {
+		return
+	}
+	for name, profile := range loaded {
+		if profile.Host == "" {
+			err = fmt.Errorf("Endpoint profile %s has no Host.", name)
+			return
+		}
+		if profile.ServicesHost == "" {
+			profile.ServicesHost = profile.Host
+		}
+		profiles[name] = profile
+	}
+	return
+}
+
+// UseEndpointProfile points api at the hosts and ports of profile.
+func (api *API) UseEndpointProfile(profile EndpointProfile) {
+	api.Host = profile.Host
+	api.ServicesHost = profile.ServicesHost
+	api.Port = profile.Port
+	api.ServicesPort = profile.ServicesPort
+}
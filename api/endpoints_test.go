@@ -0,0 +1,83 @@
+package api_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+)
+
+func writeEndpointProfiles(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEndpointProfilesWithoutFile(t *testing.T) {
+	profiles, err := api.LoadEndpointProfiles(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != len(api.DefaultEndpointProfiles()) {
+		t.Errorf("got %d profiles, want the built-in ones", len(profiles))
+	}
+	if profiles["production"].Host != "https://api.picturelife.com" {
+		t.Errorf("production profile is %+v", profiles["production"])
+	}
+}
+
+func TestLoadEndpointProfilesAddsAndOverrides(t *testing.T) {
+	path := writeEndpointProfiles(t, `{
+		"local": {"Host": "http://uploader-test", "Port": "8080"},
+		"staging": {"Host": "https://staging.example", "ServicesHost": "https://ruler.staging.example"}
+	}`)
+
+	profiles, err := api.LoadEndpointProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := profiles["local"]
+	if local.Host != "http://uploader-test" || local.Port != "8080" {
+		t.Errorf("local profile is %+v", local)
+	}
+	if local.ServicesHost != local.Host {
+		t.Errorf("ServicesHost is %q, want it to default to Host", local.ServicesHost)
+	}
+	if profiles["staging"].ServicesHost != "https://ruler.staging.example" {
+		t.Errorf("staging profile was not overridden: %+v", profiles["staging"])
+	}
+	if profiles["production"] != api.DefaultEndpointProfiles()["production"] {
+		t.Errorf("production profile changed: %+v", profiles["production"])
+	}
+}
+
+func TestLoadEndpointProfilesRequiresHost(t *testing.T) {
+	path := writeEndpointProfiles(t, `{"broken": {"ServicesHost": "https://ruler.example"}}`)
+
+	if _, err := api.LoadEndpointProfiles(path); err == nil {
+		t.Error("profile without a Host was accepted")
+	}
+}
+
+func TestLoadEndpointProfilesRejectsInvalidJSON(t *testing.T) {
+	path := writeEndpointProfiles(t, `{"local": `)
+
+	if _, err := api.LoadEndpointProfiles(path); err == nil {
+		t.Error("invalid profiles file was accepted")
+	}
+}
+
+func TestUseEndpointProfile(t *testing.T) {
+	s, a := newFakeAPI(t)
+	a.UseEndpointProfile(api.EndpointProfile{Host: s.URL, ServicesHost: s.URL})
+
+	if _, err := a.CheckSignatures([]string{"abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Calls("medias/check_signatures"); got != 1 {
+		t.Errorf("fake server got %d calls, want 1", got)
+	}
+}
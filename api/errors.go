@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// APIError describes a failed call to the Picturelife API or to Ruler. It
+// carries enough of the exchange for callers to tell an expired token from a
+// server outage from a bad request.
+type APIError struct {
+	Path       string // endpoint path, e.g. "medias/create" or "ruler"
+	HTTPStatus int    // HTTP status code, 0 if no response was received
+	Status     int64  // Picturelife status code from the response body, if any
+	Body       string // raw response body
+	Err        error  // underlying transport or parse error, if any
+
+	RetryAfter time.Duration // delay requested by a Retry-After header
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Path, e.Err.Error())
+	}
+	return fmt.Sprintf("%s: call failed (HTTP %d, status %d)", e.Path, e.HTTPStatus, e.Status)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// code returns the HTTP-style status of the failure. Picturelife status codes
+// are the HTTP status followed by two digits (20000, 40100, ...), so the body
+// status is preferred when the HTTP status itself claims success.
+func (e *APIError) code() int {
+	if e.Status >= 10000 && e.Status < 100000 && (e.HTTPStatus == 0 || e.HTTPStatus == http.StatusOK) {
+		return int(e.Status / 100)
+	}
+	if e.Status >= 100 && e.Status < 600 && (e.HTTPStatus == 0 || e.HTTPStatus == http.StatusOK) {
+		return int(e.Status)
+	}
+	return e.HTTPStatus
+}
+
+// Unauthorized reports whether the call was rejected because of the access
+// token or client credentials.
+func (e *APIError) Unauthorized() bool {
+	c := e.code()
+	return c == http.StatusUnauthorized || c == http.StatusForbidden
+}
+
+// Temporary reports whether the failure was a transport error or a server-side
+// error that may succeed if the call is made again.
+func (e *APIError) Temporary() bool {
+	if errors.Is(e.Err, context.Canceled) || errors.Is(e.Err, context.DeadlineExceeded) || errors.Is(e.Err, ErrRulerSignatureMismatch) || errors.Is(e.Err, errRulerNoProgress) {
+		return false
+	}
+	if e.HTTPStatus == 0 && e.Status == 0 {
+		return e.Err != nil
+	}
+	c := e.code()
+	return c >= 500 || c == http.StatusTooManyRequests || c == http.StatusRequestTimeout
+}
+
+// NotFound reports whether the requested object does not exist.
+func (e *APIError) NotFound() bool {
+	return e.code() == http.StatusNotFound
+}
+
+// BadRequest reports whether the server rejected the request itself.
+func (e *APIError) BadRequest() bool {
+	c := e.code()
+	return c >= 400 && c < 500 && !e.Unauthorized() && !e.Temporary()
+}
+
+// IsUnauthorized reports whether err is an APIError caused by a rejected
+// access token.
+func IsUnauthorized(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Unauthorized()
+}
+
+// IsNotFound reports whether err is an APIError for an object that does not
+// exist.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.NotFound()
+}
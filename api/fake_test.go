@@ -0,0 +1,43 @@
+package api_test
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"github.com/deet/picturelife-experimental-uploader/api/apitest"
+	"github.com/deet/picturelife-experimental-uploader/util"
+)
+
+// newFakeAPI starts a fake server and returns an API logged in to it that
+// retries without waiting.
+func newFakeAPI(t *testing.T) (*apitest.Server, *api.API) {
+	t.Helper()
+	s := apitest.NewServer()
+	t.Cleanup(s.Close)
+
+	a := &api.API{}
+	s.Configure(a)
+	policy := api.DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	policy.MaxBackoff = time.Millisecond
+	a.SetRetryPolicy(policy)
+	a.SetToken(s.IssueToken())
+	return s, a
+}
+
+// writeMedia writes size random bytes to a JPEG in a temporary directory and
+// returns its path and signature.
+func writeMedia(t *testing.T, size int) (path, sig string) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	path = filepath.Join(t.TempDir(), "photo.JPG")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, util.CalculateSignature(path)
+}
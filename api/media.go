@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+)
+
+// mediaPageSize is how many media are requested per medias/index call by
+// ListAllMedia.
+const mediaPageSize = 100
+
+type MediaResponse struct {
+	ApiResponse
+	Media Media `json:"media"`
+}
+
+type MediaListResponse struct {
+	ApiResponse
+	Media []Media `json:"media"`
+	Total int     `json:"total"`
+}
+
+func (api *API) GetMedia(mediaId string) (media Media, err error) {
+	return api.GetMediaContext(context.Background(), mediaId)
+}
+
+// GetMediaContext fetches the media with the given ID.
+func (api *API) GetMediaContext(ctx context.Context, mediaId string) (media Media, err error) {
+	params := url.Values{}
+	params.Add("id", mediaId)
+
+	response := new(MediaResponse)
+	_, err = api.CallAndParseIntoWithOutputContext(ctx, "medias/show", params, response, false)
+	if err != nil {
+		return
+	}
+
+	media = response.Media
+	return
+}
+
+func (api *API) ListMedia(offset, limit int) (medias []Media, total int, err error) {
+	return api.ListMediaContext(context.Background(), offset, limit)
+}
+
+// ListMediaContext fetches one page of the account's media, starting at offset
+// and holding at most limit media. total is the number of media in the whole
+// account.
+func (api *API) ListMediaContext(ctx context.Context, offset, limit int) (medias []Media, total int, err error) {
+	params := url.Values{}
+	params.Add("offset", strconv.Itoa(offset))
+	params.Add("limit", strconv.Itoa(limit))
+
+	response := new(MediaListResponse)
+	_, err = api.CallAndParseIntoWithOutputContext(ctx, "medias/index", params, response, false)
+	if err != nil {
+		return
+	}
+
+	medias = response.Media
+	total = response.Total
+	return
+}
+
+func (api *API) ListAllMedia() (medias []Media, err error) {
+	return api.ListAllMediaContext(context.Background())
+}
+
+// ListAllMediaContext pages through medias/index until every media in the
+// account has been fetched.
+func (api *API) ListAllMediaContext(ctx context.Context) (medias []Media, err error) {
+	for {
+		page, total, pageErr := api.ListMediaContext(ctx, len(medias), mediaPageSize)
+		if pageErr != nil {
+			err = pageErr
+			return
+		}
+		medias = append(medias, page...)
+		if len(page) == 0 || len(medias) >= total {
+			return
+		}
+	}
+}
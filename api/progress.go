@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// UploadProgress describes how far a Ruler upload has got.
+type UploadProgress struct {
+	Signature string
+	Path      string
+	BytesSent int64   // bytes of the file Ruler has or is receiving
+	Total     int64   // size of the file
+	Rate      float64 // bytes per second sent during this upload
+}
+
+type progressKey struct{}
+
+// progressInterval is the minimum time between two progress reports for the
+// same upload.
+const progressInterval = 500 * time.Millisecond
+
+// WithProgress returns a context that makes uploads started with it call
+// report as bytes are sent. Reports are throttled, and the last one is always
+// sent when the file is complete.
+func WithProgress(ctx context.Context, report func(UploadProgress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
+type progressTracker struct {
+	mu         sync.Mutex
+	report     func(UploadProgress)
+	progress   UploadProgress
+	started    time.Time
+	startBytes int64
+	lastReport time.Time
+}
+
+// newProgressTracker returns nil if ctx has no progress reporter.
+func newProgressTracker(ctx context.Context, signature, path string, total int64) *progressTracker {
+	report, ok := ctx.Value(progressKey{}).(func(UploadProgress))
+	if !ok || report == nil {
+		return nil
+	}
+	return &progressTracker{
+		report:   report,
+		progress: UploadProgress{Signature: signature, Path: path, Total: total},
+	}
+}
+
+// reader wraps r, which sends the file from offset onwards.
+func (t *progressTracker) reader(r io.Reader, offset int64) io.Reader {
+	if t == nil {
+		return r
+	}
+	t.mu.Lock()
+	if t.started.IsZero() {
+		t.started = time.Now()
+		t.startBytes = offset
+	}
+	t.progress.BytesSent = offset
+	t.mu.Unlock()
+	t.update(0, true)
+	return &progressReader{r: r, tracker: t}
+}
+
+func (t *progressTracker) update(n int64, force bool) {
+	t.mu.Lock()
+	t.progress.BytesSent += n
+	now := time.Now()
+	if !force && t.progress.BytesSent < t.progress.Total && now.Sub(t.lastReport) < progressInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.lastReport = now
+	if elapsed := now.Sub(t.started).Seconds(); elapsed > 0 {
+		t.progress.Rate = float64(t.progress.BytesSent-t.startBytes) / elapsed
+	}
+	progress := t.progress
+	t.mu.Unlock()
+
+	t.report(progress)
+}
+
+type progressReader struct {
+	r       io.Reader
+	tracker *progressTracker
+}
+
+func (p *progressReader) Read(b []byte) (n int, err error) {
+	n, err = p.r.Read(b)
+	if n > 0 {
+		p.tracker.update(int64(n), false)
+	}
+	return
+}
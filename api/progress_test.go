@@ -0,0 +1,79 @@
+package api_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"github.com/deet/picturelife-experimental-uploader/api/apitest"
+)
+
+// uploadWithProgress uploads path and returns every progress report made.
+func uploadWithProgress(t *testing.T, a *api.API, path, sig string) []api.UploadProgress {
+	t.Helper()
+	var mu sync.Mutex
+	var reports []api.UploadProgress
+	ctx := api.WithProgress(context.Background(), func(progress api.UploadProgress) {
+		mu.Lock()
+		reports = append(reports, progress)
+		mu.Unlock()
+	})
+
+	if _, _, _, err := a.UploadContext(ctx, path, sig); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) == 0 {
+		t.Fatal("no progress reported")
+	}
+	return reports
+}
+
+func TestUploadReportsProgress(t *testing.T) {
+	_, a := newFakeAPI(t)
+	a.SetChunkSize(1000)
+	path, sig := writeMedia(t, 3500)
+
+	reports := uploadWithProgress(t, a, path, sig)
+
+	var sent int64
+	for _, progress := range reports {
+		if progress.Signature != sig || progress.Path != path || progress.Total != 3500 {
+			t.Errorf("report describes the wrong file: %+v", progress)
+		}
+		if progress.BytesSent < sent {
+			t.Errorf("BytesSent went back from %d to %d", sent, progress.BytesSent)
+		}
+		sent = progress.BytesSent
+	}
+	if sent != 3500 {
+		t.Errorf("last report has %d bytes sent, want 3500", sent)
+	}
+}
+
+func TestResumedUploadReportsCompletion(t *testing.T) {
+	s, a := newFakeAPI(t)
+	a.SetChunkSize(1000)
+	path, sig := writeMedia(t, 3500)
+	s.Fail(apitest.Failure{Path: "ruler", Method: "PUT", Times: 1, DropAfterBytes: 400})
+
+	reports := uploadWithProgress(t, a, path, sig)
+
+	if last := reports[len(reports)-1]; last.BytesSent != last.Total {
+		t.Errorf("last report has %d of %d bytes sent", last.BytesSent, last.Total)
+	}
+}
+
+func TestUploadWithoutProgressReporter(t *testing.T) {
+	s, a := newFakeAPI(t)
+	path, sig := writeMedia(t, 2000)
+
+	if _, _, _, err := a.UploadContext(context.Background(), path, sig); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.UploadedBytes(sig); got != 2000 {
+		t.Errorf("Ruler holds %d bytes, want 2000", got)
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy describes how failed calls are retried. Only calls that are
+// idempotent or can be resumed are retried, and only for failures that
+// APIError.Temporary reports as temporary. A delay asked for with Retry-After
+// is honoured up to MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts    int           // total attempts including the first; 1 disables retries
+	InitialBackoff time.Duration // delay before the first retry
+	MaxBackoff     time.Duration // upper bound on any single delay
+	Multiplier     float64       // growth of the delay after each attempt
+	Jitter         float64       // fraction of the delay randomized, 0 to 1
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 1 * time.Second,
+		MaxBackoff:     2 * time.Minute,
+		Multiplier:     2,
+		Jitter:         0.5,
+	}
+}
+
+// idempotentPaths are the API endpoints that can safely be called again after
+// a failure without side effects.
+var idempotentPaths = map[string]bool{
+	"oauth/check_token":       true,
+	"medias/check_signatures": true,
+	"pending_medias/show":     true,
+	"medias/show":             true,
+	"medias/index":            true,
+	"albums/index":            true,
+	"albums/add_media":        true,
+}
+
+// SetRetryPolicy replaces the retry policy used for every call made through
+// api.
+func (api *API) SetRetryPolicy(policy RetryPolicy) {
+	api.retryPolicy = &policy
+}
+
+func (api *API) retry() RetryPolicy {
+	if api.retryPolicy != nil {
+		return *api.retryPolicy
+	}
+	return DefaultRetryPolicy()
+}
+
+// backoff returns the delay before retry number attempt (starting at 1).
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(policy.InitialBackoff) * math.Pow(policy.Multiplier, float64(attempt-1))
+	if policy.MaxBackoff > 0 && delay > float64(policy.MaxBackoff) {
+		delay = float64(policy.MaxBackoff)
+	}
+	if policy.Jitter > 0 {
+		delay = delay * (1 - policy.Jitter*rand.Float64())
+	}
+	return time.Duration(delay)
+}
+
+// withRetry calls fn until it succeeds, fails with an error that is not
+// temporary, the context is done, or the policy's attempts are used up.
+func (api *API) withRetry(ctx context.Context, name string, fn func() error) (err error) {
+	policy := api.retry()
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || !apiErr.Temporary() {
+			return
+		}
+		if attempt >= policy.MaxAttempts {
+			log.Printf("%s failed after %d attempts: %s\n", name, attempt, err)
+			return
+		}
+
+		delay := policy.backoff(attempt)
+		if apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+			// The server does not get to hold an upload slot for longer
+			// than the policy allows
+			if policy.MaxBackoff > 0 && delay > policy.MaxBackoff {
+				delay = policy.MaxBackoff
+			}
+		}
+		log.Printf("%s failed (attempt %d of %d), retrying in %s: %s\n", name, attempt, policy.MaxAttempts, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an
+// HTTP date.
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
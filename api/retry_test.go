@@ -0,0 +1,121 @@
+package api_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"github.com/deet/picturelife-experimental-uploader/api/apitest"
+)
+
+func TestTemporaryErrorIsRetried(t *testing.T) {
+	s, a := newFakeAPI(t)
+	s.Fail(apitest.Failure{Path: "medias/check_signatures", Times: 2, HTTPStatus: 503})
+
+	if _, err := a.CheckSignatures([]string{"abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Calls("medias/check_signatures"); got != 3 {
+		t.Errorf("made %d calls, want 3", got)
+	}
+}
+
+func TestDroppedConnectionIsRetried(t *testing.T) {
+	s, a := newFakeAPI(t)
+	s.Fail(apitest.Failure{Path: "medias/check_signatures", Times: 1, Drop: true})
+
+	if _, err := a.CheckSignatures([]string{"abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Calls("medias/check_signatures"); got != 2 {
+		t.Errorf("made %d calls, want 2", got)
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	s, a := newFakeAPI(t)
+	s.Fail(apitest.Failure{Path: "medias/check_signatures"})
+
+	_, err := a.CheckSignatures([]string{"abc"})
+	if err == nil {
+		t.Fatal("call succeeded")
+	}
+	if got, want := s.Calls("medias/check_signatures"), api.DefaultRetryPolicy().MaxAttempts; got != want {
+		t.Errorf("made %d calls, want %d", got, want)
+	}
+}
+
+func TestBadRequestIsNotRetried(t *testing.T) {
+	s, a := newFakeAPI(t)
+	s.Fail(apitest.Failure{Path: "medias/check_signatures", HTTPStatus: 400})
+
+	_, err := a.CheckSignatures([]string{"abc"})
+	var apiErr *api.APIError
+	if !errors.As(err, &apiErr) || !apiErr.BadRequest() {
+		t.Fatalf("got %v, want a bad request", err)
+	}
+	if got := s.Calls("medias/check_signatures"); got != 1 {
+		t.Errorf("made %d calls, want 1", got)
+	}
+}
+
+func TestCreateIsNotRetried(t *testing.T) {
+	s, a := newFakeAPI(t)
+	path, sig := writeMedia(t, 1000)
+	s.Fail(apitest.Failure{Path: "medias/create", Times: 1})
+
+	if _, _, _, err := a.Upload(path, sig); err == nil {
+		t.Fatal("upload succeeded")
+	}
+	if got := s.Calls("medias/create"); got != 1 {
+		t.Errorf("made %d calls, want 1", got)
+	}
+}
+
+func TestRetryAfterIsHonoured(t *testing.T) {
+	s, a := newFakeAPI(t)
+	policy := api.DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	a.SetRetryPolicy(policy)
+	s.Fail(apitest.Failure{Path: "medias/check_signatures", Times: 1, HTTPStatus: 429, RetryAfter: time.Second})
+
+	start := time.Now()
+	if _, err := a.CheckSignatures([]string{"abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want at least 1s", elapsed)
+	}
+}
+
+func TestRetryAfterIsCappedByMaxBackoff(t *testing.T) {
+	s, a := newFakeAPI(t)
+	policy := api.DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	policy.MaxBackoff = 10 * time.Millisecond
+	a.SetRetryPolicy(policy)
+	s.Fail(apitest.Failure{Path: "medias/check_signatures", Times: 1, HTTPStatus: 503, RetryAfter: 24 * time.Hour})
+
+	start := time.Now()
+	if _, err := a.CheckSignatures([]string{"abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retried after %s, want at most MaxBackoff", elapsed)
+	}
+}
+
+func TestRulerHeadFailureIsRetried(t *testing.T) {
+	s, a := newFakeAPI(t)
+	a.SetChunkSize(1000)
+	path, sig := writeMedia(t, 2500)
+	s.Fail(apitest.Failure{Path: "ruler", Method: "HEAD", Times: 2, HTTPStatus: 502})
+
+	if _, _, _, err := a.Upload(path, sig); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.UploadedBytes(sig); got != 2500 {
+		t.Errorf("Ruler holds %d bytes, want 2500", got)
+	}
+}
@@ -2,9 +2,11 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -15,6 +17,29 @@ import (
 	"strconv"
 )
 
+// SetChunkSize makes Ruler uploads send files in PUTs of at most size bytes,
+// each confirmed with a HEAD before the next is sent. Zero sends the whole
+// file in one PUT.
+func (api *API) SetChunkSize(size int64) {
+	api.chunkSize = size
+}
+
+func (api *API) ChunkSize() int64 {
+	return api.chunkSize
+}
+
+// ErrRulerSignatureMismatch is wrapped by the APIError returned when Ruler
+// calculates a different signature for the uploaded bytes than was sent.
+var ErrRulerSignatureMismatch = errors.New("Ruler calculated different signature. Upload must be retried.")
+
+// errRulerNoSize and errRulerNoProgress stop a chunked upload that Ruler
+// accepts without confirming that it stored anything, which would otherwise
+// send the same chunk forever.
+var (
+	errRulerNoSize     = errors.New("Ruler did not report how many bytes it has.")
+	errRulerNoProgress = errors.New("Ruler did not store any of the chunk.")
+)
+
 type RulerResponse struct {
 	Status    int64
 	Location  string
@@ -22,99 +47,257 @@ type RulerResponse struct {
 	Signature string
 }
 
-func (api *API) rulerUpload(filePath, localSig string, restart bool) (location, signature string, err error) {
+// rulerURL returns the Ruler URL of the upload of the file at filePath with
+// signature sig, with the current access token.
+func (api *API) rulerURL(filePath, sig string) string {
+	extension := strings.ToUpper(filepath.Ext(filePath))
+	fakeFilename := fmt.Sprintf("%s%s", sig, extension)
+
+	params := url.Values{}
+	params.Add("access_token", api.Token().Token)
+	params.Add("filename", fakeFilename)
+	params.Add("signature", sig)
+	return fmt.Sprintf("%s?%s", api.MakeServicesPath("ruler"), params.Encode())
+}
+
+func (api *API) DiscardUpload(filePath, sig string) error {
+	return api.DiscardUploadContext(context.Background(), filePath, sig)
+}
+
+// DiscardUploadContext deletes whatever Ruler holds of the upload of the file
+// at filePath with signature sig.
+func (api *API) DiscardUploadContext(ctx context.Context, filePath, sig string) error {
+	api.ensureFreshToken(ctx)
+	return api.withRetry(ctx, "Ruler DELETE", func() error {
+		return api.rulerDelete(ctx, api.rulerURL(filePath, sig))
+	})
+}
+
+func (api *API) rulerUpload(ctx context.Context, filePath, localSig string, restart bool) (location, signature string, err error) {
 	niceLog := func(parts ...string) {
 		log.Println("RULER (", filePath, ") ", strings.Join(parts, " "))
 	}
 
-	defer func() {
-		if e := recover(); e != nil {
-			niceLog("Error:", e.(string))
-		}
-	}()
-
 	file, err := os.Open(filePath)
 	if err != nil {
-		panic("Could not open file")
+		niceLog("Could not open file:", err.Error())
+		return
 	}
 	defer file.Close()
 
-	client := &http.Client{}
 	//fileName := path.Base(filePath)
 	fileInfo, _ := file.Stat()
 	fileSize := fileInfo.Size()
 
-	extension := strings.ToUpper(filepath.Ext(filePath))
-	fakeFilename := fmt.Sprintf("%s%s", localSig, extension)
-
-	//log.Println("using fakeFilename for ruler:", fakeFilename)
-
-	params := url.Values{}
-	params.Add("access_token", api.AccessToken.Token)
-	params.Add("filename", fakeFilename)
-	params.Add("signature", localSig)
-
-	url := fmt.Sprintf("%s/ruler?%s", api.ServicesHost, params.Encode())
+	api.ensureFreshToken(ctx)
+	usedToken := api.Token().Token
+	rulerURL := func() string {
+		return api.rulerURL(filePath, localSig)
+	}
+	url := rulerURL()
 
-	var bytesCompleted int64 = 0
 	if restart {
 		log.Println("Restarting RULER upload")
-		req, err := http.NewRequest("DELETE", url, nil)
+		err = api.withRetry(ctx, "Ruler DELETE", func() error {
+			return api.rulerDelete(ctx, url)
+		})
 		if err != nil {
-			panic(fmt.Sprintln("Could not form DELETE request", err))
+			niceLog("Error restarting Ruler upload:", err.Error())
+			return
 		}
+	}
 
-		deleteResp, err := client.Do(req)
-		if err != nil {
-			panic(fmt.Sprintln("Error restarting Ruler upload:", err))
+	// The file is sent in chunks of chunkSize bytes, or in one PUT when
+	// chunking is off. Each attempt asks Ruler how much it already has and
+	// sends the next chunk from there, so a failed PUT resumes rather than
+	// starting over and at most one chunk is lost. Straight after a restart
+	// Ruler has nothing and the first HEAD is skipped.
+	chunkSize := api.ChunkSize()
+	if chunkSize <= 0 {
+		chunkSize = fileSize
+	}
+	var parsedResponse RulerResponse
+	var offset int64
+	needHead := !restart
+	progress := newProgressTracker(ctx, localSig, filePath, fileSize)
+	done := false
+	sendChunk := func() (attemptErr error) {
+		if needHead {
+			offset, attemptErr = api.rulerOffset(ctx, url)
+			if errors.Is(attemptErr, errRulerNoSize) {
+				// Before anything was sent this means Ruler has nothing
+				offset, attemptErr = 0, nil
+			}
+			if attemptErr != nil {
+				return
+			}
+			niceLog("Bytes completed: ", strconv.Itoa(int(offset)))
+			// Ruler holding the whole file without having answered, or more
+			// than the file now has because it shrank, leaves nothing valid
+			// to send. Discard what it has and send the file again.
+			if offset > 0 && offset >= fileSize {
+				niceLog("Ruler has", strconv.Itoa(int(offset)), "bytes of a", strconv.Itoa(int(fileSize)), "byte file, restarting upload")
+				attemptErr = api.rulerDelete(ctx, url)
+				if attemptErr != nil {
+					return
+				}
+				offset = 0
+			}
+			if offset > 0 {
+				niceLog("Resuming failed uploaded from byte:", strconv.Itoa(int(offset)), " (filesize: ", strconv.Itoa(int(fileSize)), ")")
+			}
 		}
-		defer deleteResp.Body.Close()
-	} else {
-		resp, err := client.Head(url)
-		if err != nil {
-			panic(fmt.Sprintln("Could not HEAD url", err))
+		// A retry of this chunk must confirm the offset again
+		needHead = true
+
+		end := offset + chunkSize
+		if end > fileSize {
+			end = fileSize
+		}
+		_, attemptErr = file.Seek(offset, 0)
+		if attemptErr != nil {
+			return
 		}
 
-		if resp.Header.Get("X-Ruler-Error") != "" {
-			panic(fmt.Sprintln("Ruler HEAD error:", resp.Header["X-Ruler-Error"]))
+		parsedResponse, attemptErr = api.rulerPut(ctx, url, progress.reader(api.bandwidthLimiter.reader(ctx, io.LimitReader(file, end-offset)), offset), offset, end, fileSize)
+		if attemptErr != nil {
+			return
+		}
+		if end == fileSize {
+			done = true
+			return
 		}
 
-		bytesCompleted, err = strconv.ParseInt(resp.Header.Get("X-Ruler-Size"), 10, 64)
-		if err != nil {
-			niceLog("Could not parse ruler size: ", resp.Header.Get("X-Ruler-Size"))
-		} else {
-			niceLog("Bytes completed: ", strconv.Itoa(int(bytesCompleted)))
+		// Confirm how much Ruler actually stored before sending the next chunk
+		confirmed, attemptErr := api.rulerOffset(ctx, url)
+		if attemptErr != nil {
+			return
 		}
-		file.Seek(bytesCompleted, 0)
+		if confirmed <= offset {
+			niceLog("Ruler still has", strconv.Itoa(int(confirmed)), "bytes after a chunk from byte", strconv.Itoa(int(offset)))
+			attemptErr = &APIError{Path: "ruler", Err: errRulerNoProgress}
+			return
+		}
+		offset = confirmed
+		niceLog("Chunk confirmed, bytes completed: ", strconv.Itoa(int(offset)))
+		needHead = false
+		return
+	}
+	upload := func() (uploadErr error) {
+		for !done {
+			uploadErr = api.withRetry(ctx, "Ruler upload", sendChunk)
+			if uploadErr != nil {
+				return
+			}
+		}
+		return
+	}
+	err = upload()
+	if err != nil && IsUnauthorized(err) && api.refreshRejectedToken(ctx, usedToken) {
+		niceLog("Access token rejected, resuming with refreshed token")
+		url = rulerURL()
+		needHead = true
+		err = upload()
+	}
+	if err != nil {
+		niceLog("Error message", err.Error())
+		return
+	}
+
+	//niceLog("Received location from RULER:", parsedResponse.Location)
+	//niceLog("Received signature from RULER:", parsedResponse.Signature)
+
+	signature = parsedResponse.Signature
+	location = parsedResponse.Location
+
+	return
+}
+
+// rulerDelete discards any partial upload Ruler holds for url.
+func (api *API) rulerDelete(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	if err != nil {
+		return &APIError{Path: "ruler", Err: redactError(err)}
+	}
+
+	resp, err := api.do(req)
+	if err != nil {
+		return &APIError{Path: "ruler", Err: err}
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return &APIError{Path: "ruler", HTTPStatus: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header)}
+	}
+	return nil
+}
+
+// rulerOffset asks Ruler how many bytes of the upload at url it already has.
+// A response without a valid X-Ruler-Size header fails with errRulerNoSize.
+func (api *API) rulerOffset(ctx context.Context, url string) (bytesCompleted int64, err error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		err = &APIError{Path: "ruler", Err: redactError(err)}
+		return
+	}
+
+	resp, err := api.do(req)
+	if err != nil {
+		err = &APIError{Path: "ruler", Err: err}
+		return
+	}
+	resp.Body.Close()
+
+	if resp.Header.Get("X-Ruler-Error") != "" {
+		log.Println("Ruler HEAD error:", resp.Header.Get("X-Ruler-Error"))
+		err = &APIError{Path: "ruler", HTTPStatus: resp.StatusCode, Err: errors.New(resp.Header.Get("X-Ruler-Error")), RetryAfter: parseRetryAfter(resp.Header)}
+		return
+	}
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		err = &APIError{Path: "ruler", HTTPStatus: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header)}
+		return
 	}
 
-	req, err := http.NewRequest("PUT", url, file)
+	bytesCompleted, parseErr := strconv.ParseInt(resp.Header.Get("X-Ruler-Size"), 10, 64)
+	if parseErr != nil || bytesCompleted < 0 {
+		log.Println("Could not parse ruler size: ", resp.Header.Get("X-Ruler-Size"))
+		err = &APIError{Path: "ruler", HTTPStatus: resp.StatusCode, Err: errRulerNoSize}
+		bytesCompleted = 0
+	}
+	return
+}
+
+// rulerPut sends body, which holds the bytes of the file from start up to
+// (but not including) end, and parses Ruler's response. Only the PUT that
+// reaches the end of the file gets a location back.
+func (api *API) rulerPut(ctx context.Context, url string, body io.Reader, start, end, fileSize int64) (parsedResponse RulerResponse, err error) {
+	if start < 0 || end < start || end > fileSize {
+		// Not an APIError, so that withRetry does not send it again
+		err = fmt.Errorf("Invalid upload range %d-%d of %d bytes.", start, end, fileSize)
+		return
+	}
+	// The transport closes a request body that is an io.Closer, which would
+	// close the file before a retry could resume from it.
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, io.NopCloser(body))
 	if err != nil {
-		panic(fmt.Sprintln("Could not form request", err))
+		err = &APIError{Path: "ruler", Err: redactError(err)}
+		return
 	}
-	req.ContentLength = (fileSize - bytesCompleted)
-	if bytesCompleted > 0 {
-		niceLog("Resuming failed uploaded from byte:", strconv.Itoa(int(bytesCompleted)), " (filesize: ", strconv.Itoa(int(fileSize)), ")")
-		contentRangeValue := fmt.Sprintf("bytes %d-%d/%d", bytesCompleted, fileSize, fileSize)
-		niceLog("Setting Content-Range", contentRangeValue)
+	req.ContentLength = (end - start)
+	if start > 0 || end < fileSize {
+		// Ruler takes the end of the range as the offset after the last byte
+		// sent, not the inclusive last byte, so a resume of the rest of the
+		// file is "bytes start-fileSize/fileSize".
+		contentRangeValue := fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize)
+		log.Println("Setting Content-Range", contentRangeValue)
 		req.Header.Set("Content-Range", contentRangeValue)
-	} else {
-		niceLog("Not setting Content-Range because bytesCompleted: ", strconv.Itoa(int(bytesCompleted)))
 	}
 
 	//log.Printf("RULE REQUEST: %#v", req)
 
-	resp, err := client.Do(req)
+	resp, err := api.do(req)
 	if err != nil {
-		if resp != nil {
-			for k, v := range resp.Header {
-				for _, v2 := range v {
-					niceLog("Error header ", k, " : ", v2)
-				}
-			}
-		}
-		niceLog("Error message", err.Error())
-		err = errors.New(fmt.Sprintf("Error during Ruler upload: %s", err.Error()))
+		err = &APIError{Path: "ruler", Err: err}
 		return
 	}
 	defer resp.Body.Close()
@@ -122,38 +305,41 @@ func (api *API) rulerUpload(filePath, localSig string, restart bool) (location,
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(resp.Body)
 
-	fmt.Println(url)
-	fmt.Println(resp.Body)
+	retryAfter := parseRetryAfter(resp.Header)
 
-	var parsedResponse RulerResponse
+	if end < fileSize && resp.StatusCode < 300 && buf.Len() == 0 {
+		return
+	}
 
 	err = json.Unmarshal(buf.Bytes(), &parsedResponse)
 	if err != nil {
-		err = errors.New("Ruler returned invalid response.")
+		err = &APIError{Path: "ruler", HTTPStatus: resp.StatusCode, Body: buf.String(), Err: errors.New("Ruler returned invalid response."), RetryAfter: retryAfter}
 		return
 	}
 
 	if parsedResponse.Status == 519256 {
-		niceLog("Ruler calculated different signature. Upload must be retried.")
-		err = errors.New("Ruler calculated different signature. Upload must be retried.")
+		log.Println("Ruler calculated different signature. Upload must be retried.")
+		err = &APIError{Path: "ruler", HTTPStatus: resp.StatusCode, Status: parsedResponse.Status, Body: buf.String(), Err: ErrRulerSignatureMismatch}
 		return
 	}
 
 	if parsedResponse.Error != "" {
-		niceLog("Error ", strconv.Itoa(int(parsedResponse.Status)), parsedResponse.Error)
-		err = errors.New(fmt.Sprintf("Error (%d) %s", parsedResponse.Status, parsedResponse.Error))
+		log.Println("Ruler error ", strconv.Itoa(int(parsedResponse.Status)), parsedResponse.Error)
+		err = &APIError{Path: "ruler", HTTPStatus: resp.StatusCode, Status: parsedResponse.Status, Body: buf.String(), Err: errors.New(parsedResponse.Error), RetryAfter: retryAfter}
 		return
 	}
 
-	if parsedResponse.Location == "" {
-		panic("Location is missing.")
+	if end < fileSize {
+		if resp.StatusCode >= 300 {
+			err = &APIError{Path: "ruler", HTTPStatus: resp.StatusCode, Status: parsedResponse.Status, Body: buf.String(), RetryAfter: retryAfter}
+		}
+		return
 	}
 
-	//niceLog("Received location from RULER:", parsedResponse.Location)
-	//niceLog("Received signature from RULER:", parsedResponse.Signature)
-
-	signature = parsedResponse.Signature
-	location = parsedResponse.Location
+	if parsedResponse.Location == "" {
+		err = &APIError{Path: "ruler", HTTPStatus: resp.StatusCode, Status: parsedResponse.Status, Body: buf.String(), Err: errors.New("Location is missing.")}
+		return
+	}
 
 	return
 }
@@ -0,0 +1,88 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/deet/picturelife-experimental-uploader/api/apitest"
+)
+
+func TestChunkedUpload(t *testing.T) {
+	s, a := newFakeAPI(t)
+	a.SetChunkSize(1000)
+	path, sig := writeMedia(t, 3500)
+
+	pendingMediaId, _, _, err := a.Upload(path, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pendingMediaId == "" {
+		t.Error("no pending media ID")
+	}
+	if got := s.UploadedBytes(sig); got != 3500 {
+		t.Errorf("Ruler holds %d bytes, want 3500", got)
+	}
+}
+
+func TestChunkedUploadResumesDroppedChunk(t *testing.T) {
+	s, a := newFakeAPI(t)
+	a.SetChunkSize(1000)
+	path, sig := writeMedia(t, 3500)
+	s.Fail(apitest.Failure{Path: "ruler", Method: "PUT", Times: 1, DropAfterBytes: 400})
+
+	_, _, _, err := a.Upload(path, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.UploadedBytes(sig); got != 3500 {
+		t.Errorf("Ruler holds %d bytes, want 3500", got)
+	}
+}
+
+func TestUploadRestartsWhenRulerHasWholeFile(t *testing.T) {
+	s, a := newFakeAPI(t)
+	path, sig := writeMedia(t, 2000)
+	// Ruler keeps every byte but the response is lost, so the retry finds
+	// nothing left to send
+	s.Fail(apitest.Failure{Path: "ruler", Method: "PUT", Times: 1, DropAfterBytes: 2000})
+
+	pendingMediaId, _, _, err := a.Upload(path, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pendingMediaId == "" {
+		t.Error("no pending media ID")
+	}
+	if got := s.UploadedBytes(sig); got != 2000 {
+		t.Errorf("Ruler holds %d bytes, want 2000", got)
+	}
+}
+
+func TestChunkedUploadStopsWhenRulerStoresNothing(t *testing.T) {
+	s, a := newFakeAPI(t)
+	a.SetChunkSize(1000)
+	path, sig := writeMedia(t, 3500)
+	s.Fail(apitest.Failure{Path: "ruler", Method: "PUT", DiscardBytes: true})
+
+	if _, _, _, err := a.Upload(path, sig); err == nil {
+		t.Fatal("upload succeeded")
+	}
+	if got := s.Calls("ruler"); got > 3 {
+		t.Errorf("made %d Ruler calls, want the chunk sent once", got)
+	}
+}
+
+func TestChunkedUploadStopsWithoutRulerSize(t *testing.T) {
+	s, a := newFakeAPI(t)
+	a.SetChunkSize(1000)
+	path, sig := writeMedia(t, 3500)
+	// The HEAD before the first chunk may leave the size out for an upload
+	// Ruler has not seen, the one confirming a chunk may not
+	s.Fail(apitest.Failure{Path: "ruler", Method: "HEAD", OmitRulerSize: true})
+
+	if _, _, _, err := a.Upload(path, sig); err == nil {
+		t.Fatal("upload succeeded")
+	}
+	if got := s.UploadedBytes(sig); got != 1000 {
+		t.Errorf("Ruler holds %d bytes, want the first chunk only", got)
+	}
+}
@@ -1,8 +1,13 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/url"
+	"sync"
+	"time"
 )
 
 type AccessToken struct {
@@ -11,6 +16,119 @@ type AccessToken struct {
 	RefreshToken string
 	Expires      float64
 	Email        string
+	ExpiresAt    time.Time
+}
+
+// tokenRefreshMargin is how long before ExpiresAt a token is refreshed.
+const tokenRefreshMargin = 5 * time.Minute
+
+// session holds the access token of an API. It is shared by copies of the API
+// made by assignment; WithToken makes a copy with a session of its own.
+type session struct {
+	lock  sync.RWMutex // guards token
+	token AccessToken
+	// refreshLock serializes token refreshes so that concurrent uploads
+	// hitting an expired token only refresh it once.
+	refreshLock sync.Mutex
+}
+
+// sessionInit guards the creation of the session of an API.
+var sessionInit sync.Mutex
+
+func (api *API) currentSession() *session {
+	sessionInit.Lock()
+	defer sessionInit.Unlock()
+	if api.session == nil {
+		api.session = &session{}
+	}
+	return api.session
+}
+
+// Token returns the access token used by api.
+func (api *API) Token() AccessToken {
+	s := api.currentSession()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.token
+}
+
+// SetToken makes api use token. A token saved before ExpiresAt was recorded
+// gets it from Expires.
+func (api *API) SetToken(token AccessToken) {
+	s := api.currentSession()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.token = token.withExpiresAt()
+}
+
+// WithToken returns a copy of api that uses token. The copy has its own
+// session and no token refresh handler.
+func (api *API) WithToken(token AccessToken) *API {
+	copied := *api
+	copied.session = nil
+	copied.tokenRefreshHandler = nil
+	copied.SetToken(token)
+	return &copied
+}
+
+// apiFields is API without its methods, for encoding it with its token.
+type apiFields API
+
+// MarshalJSON encodes api with its access token.
+func (api API) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		AccessToken AccessToken
+		apiFields
+	}{api.Token(), apiFields(api)})
+}
+
+// UnmarshalJSON decodes an API encoded by MarshalJSON.
+func (api *API) UnmarshalJSON(data []byte) error {
+	decoded := struct {
+		AccessToken AccessToken
+		*apiFields
+	}{apiFields: (*apiFields)(api)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	api.SetToken(decoded.AccessToken)
+	return nil
+}
+
+// newAccessToken builds an AccessToken from an oauth/access_token response.
+// Expires is sent either as a Unix timestamp or as a number of seconds from
+// now; both are turned into ExpiresAt.
+func newAccessToken(response LoginResponse) AccessToken {
+	token := AccessToken{
+		Token:        response.Token,
+		UserId:       response.UserId,
+		RefreshToken: response.RefreshToken,
+		Expires:      response.Expires,
+		Email:        response.Email,
+	}
+	return token.withExpiresAt()
+}
+
+// withExpiresAt returns token with ExpiresAt derived from Expires if it is not
+// set. A relative Expires is counted from now.
+func (token AccessToken) withExpiresAt() AccessToken {
+	if !token.ExpiresAt.IsZero() {
+		return token
+	}
+	if token.Expires > 1000000000 {
+		token.ExpiresAt = time.Unix(int64(token.Expires), 0)
+	} else if token.Expires > 0 {
+		token.ExpiresAt = time.Now().Add(time.Duration(token.Expires) * time.Second)
+	}
+	return token
+}
+
+// NeedsRefresh reports whether the token expires soon and can be refreshed.
+func (token AccessToken) NeedsRefresh() bool {
+	if token.RefreshToken == "" || token.ExpiresAt.IsZero() {
+		return false
+	}
+	return time.Now().Add(tokenRefreshMargin).After(token.ExpiresAt)
 }
 
 type LoginResponse struct {
@@ -30,9 +148,11 @@ type CheckTokenResponse struct {
 }
 
 func (api *API) Login(email, password string) (token AccessToken, err error) {
-	path := "oauth/access_token"
+	return api.LoginContext(context.Background(), email, password)
+}
 
-	api.AccessToken.Token = ""
+func (api *API) LoginContext(ctx context.Context, email, password string) (token AccessToken, err error) {
+	path := "oauth/access_token"
 
 	params := url.Values{}
 	params.Add("email", email)
@@ -42,58 +162,148 @@ func (api *API) Login(email, password string) (token AccessToken, err error) {
 	params.Add("client_secret", api.ClientSecret)
 	params.Add("client_uuid", "Open source install")
 
-	log.Println("Params:", params)
-
-	defer func() {
-		if r := recover(); r != nil {
-			if r == "Call failed" {
-				log.Println("Login failed because call failed")
-				return
-			}
-		}
-	}()
-
 	var loginResponse LoginResponse
-	api.CallAndParseIntoWithOutput(path, params, &loginResponse, true)
+	_, err = api.CallAndParseIntoWithOutputContext(ctx, path, params, &loginResponse, false)
+	if err != nil {
+		log.Println("Login failed because call failed:", err)
+		return
+	}
 
 	if loginResponse.Token == "" {
-		panic("Login error")
+		err = errors.New("Login response did not contain an access token.")
+		return
+	}
+	token = newAccessToken(loginResponse)
+
+	return
+}
+
+// SetTokenRefreshHandler registers a function that is called with the new
+// token every time the access token is refreshed, so that it can be saved.
+func (api *API) SetTokenRefreshHandler(handler func(AccessToken)) {
+	api.tokenRefreshHandler = handler
+}
+
+func (api *API) RefreshAccessToken() (token AccessToken, err error) {
+	return api.RefreshAccessTokenContext(context.Background())
+}
+
+// RefreshAccessTokenContext exchanges the stored refresh token for a new access
+// token using the refresh_token grant and stores it on api.
+func (api *API) RefreshAccessTokenContext(ctx context.Context) (token AccessToken, err error) {
+	s := api.currentSession()
+	s.refreshLock.Lock()
+	defer s.refreshLock.Unlock()
+	return api.refreshAccessToken(ctx)
+}
+
+func (api *API) refreshAccessToken(ctx context.Context) (token AccessToken, err error) {
+	path := "oauth/access_token"
+
+	current := api.Token()
+	if current.RefreshToken == "" {
+		err = errors.New("No refresh token available.")
+		return
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", "refresh_token")
+	params.Add("refresh_token", current.RefreshToken)
+	params.Add("client_id", api.ClientId)
+	params.Add("client_secret", api.ClientSecret)
+
+	var refreshResponse LoginResponse
+	_, err = api.CallAndParseIntoWithOutputContext(ctx, path, params, &refreshResponse, false)
+	if err != nil {
+		log.Println("Token refresh failed:", err)
+		return
+	}
+
+	if refreshResponse.Token == "" {
+		err = errors.New("Refresh response did not contain an access token.")
+		return
 	}
-	token = AccessToken{
-		Token:        loginResponse.Token,
-		UserId:       loginResponse.UserId,
-		RefreshToken: loginResponse.RefreshToken,
-		Expires:      loginResponse.Expires,
-		Email:        loginResponse.Email,
+	token = newAccessToken(refreshResponse)
+	if token.RefreshToken == "" {
+		token.RefreshToken = current.RefreshToken
+	}
+	if token.UserId == "" {
+		token.UserId = current.UserId
+	}
+	if token.Email == "" {
+		token.Email = current.Email
 	}
 
+	log.Println("Refreshed access token")
+	api.SetToken(token)
+	if api.tokenRefreshHandler != nil {
+		api.tokenRefreshHandler(token)
+	}
 	return
 }
 
-func (api *API) CheckToken(tokenString string) (validToken bool) {
+// ensureFreshToken refreshes the access token if it is about to expire.
+func (api *API) ensureFreshToken(ctx context.Context) {
+	if !api.Token().NeedsRefresh() {
+		return
+	}
+	s := api.currentSession()
+	s.refreshLock.Lock()
+	defer s.refreshLock.Unlock()
+	// Another call may have refreshed it while we waited for the lock
+	if !api.Token().NeedsRefresh() {
+		return
+	}
+	api.refreshAccessToken(ctx)
+}
+
+// refreshRejectedToken is called after a call failed because rejectedToken was
+// refused. It refreshes the access token unless another call already did, and
+// reports whether the failed call should be made again.
+func (api *API) refreshRejectedToken(ctx context.Context, rejectedToken string) bool {
+	if api.Token().RefreshToken == "" {
+		return false
+	}
+	s := api.currentSession()
+	s.refreshLock.Lock()
+	defer s.refreshLock.Unlock()
+	if api.Token().Token != rejectedToken {
+		return true
+	}
+	_, err := api.refreshAccessToken(ctx)
+	return err == nil
+}
+
+// CheckToken reports whether tokenString is still accepted by the API. A
+// token the API rejects is reported as invalid with a nil error; err is only
+// set when the check itself could not be completed.
+func (api *API) CheckToken(tokenString string) (validToken bool, err error) {
+	return api.CheckTokenContext(context.Background(), tokenString)
+}
+
+func (api *API) CheckTokenContext(ctx context.Context, tokenString string) (validToken bool, err error) {
 	//return true
 	path := "oauth/check_token"
 
 	params := url.Values{}
 	params.Add("access_token", tokenString)
 
-	defer func() {
-		if r := recover(); r != nil {
-			if r == "Call failed" {
-				log.Println("Check token failed because call failed")
-				validToken = false
-				return
-			}
-		}
-	}()
-
 	var checkTokenResponse CheckTokenResponse
-	api.CallAndParseIntoWithOutput(path, params, &checkTokenResponse, false)
+	_, err = api.CallAndParseIntoWithOutputContext(ctx, path, params, &checkTokenResponse, false)
+	if err != nil {
+		if IsUnauthorized(err) {
+			log.Println("Bad token:", err)
+			err = nil
+			return
+		}
+		log.Println("Check token failed because call failed:", err)
+		return
+	}
 
 	if checkTokenResponse.TokenStatus.Expired == false {
 		log.Println("Good token, returning true")
 		validToken = true
-		return true
+		return
 	}
 
 	log.Println("Bad token")
@@ -0,0 +1,105 @@
+package api_test
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+)
+
+func TestTokenIsSavedWithAPI(t *testing.T) {
+	var a api.API
+	a.Host = "https://api.example.com"
+	a.SetToken(api.AccessToken{Token: "token", Email: "someone@example.com"})
+
+	data, err := json.Marshal(&a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded api.API
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Host != a.Host || loaded.Token().Token != "token" || loaded.Token().Email != "someone@example.com" {
+		t.Errorf("loaded %s as host %q token %+v", data, loaded.Host, loaded.Token())
+	}
+}
+
+func TestSavedTokenWithoutExpiresAtGetsIt(t *testing.T) {
+	expires := time.Now().Add(time.Minute).Unix()
+	saved := []byte(`{"AccessToken":{"Token":"token","RefreshToken":"refresh","Expires":` + jsonNumber(expires) + `}}`)
+
+	var a api.API
+	if err := json.Unmarshal(saved, &a); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Token().ExpiresAt.Unix(); got != expires {
+		t.Errorf("ExpiresAt is %d, want %d", got, expires)
+	}
+	if !a.Token().NeedsRefresh() {
+		t.Error("token expiring in a minute does not need a refresh")
+	}
+}
+
+func jsonNumber(n int64) string {
+	data, _ := json.Marshal(n)
+	return string(data)
+}
+
+func TestConcurrentCallsRefreshRejectedTokenOnce(t *testing.T) {
+	s, a := newFakeAPI(t)
+	s.ExpireToken(a.Token().Token)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.ListAlbums(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls := s.Calls("oauth/access_token"); calls != 1 {
+		t.Errorf("token refreshed %d times, want once", calls)
+	}
+}
+
+func TestWithTokenHasItsOwnSession(t *testing.T) {
+	var a api.API
+	a.SetToken(api.AccessToken{Token: "default"})
+	account := a.WithToken(api.AccessToken{Token: "account"})
+	if a.Token().Token != "default" || account.Token().Token != "account" {
+		t.Errorf("tokens are %q and %q", a.Token().Token, account.Token().Token)
+	}
+}
+
+func TestCheckTokenWhileTokensChange(t *testing.T) {
+	s, a := newFakeAPI(t)
+	token := a.Token().Token
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				a.CheckToken(token)
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		s.ExpireToken(token)
+		time.Sleep(time.Millisecond)
+	}
+	s.RevokeTokens()
+	wg.Wait()
+
+	if valid, err := a.CheckToken(token); err == nil && valid {
+		t.Error("revoked token is still valid")
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// secretParams are request parameters whose values are never written to the
+// log.
+var secretParams = map[string]bool{
+	"password":      true,
+	"client_secret": true,
+	"access_token":  true,
+	"refresh_token": true,
+	"code":          true,
+}
+
+// SetTracing turns logging of every request and response made through api on
+// or off. Each exchange is logged as one line with the method, endpoint,
+// status, latency and body sizes. Secrets in the URL are redacted and request
+// and response bodies are never logged.
+func (api *API) SetTracing(enabled bool) {
+	api.tracing = enabled
+}
+
+// Redact returns a placeholder for secret that shows whether it is set without
+// revealing it.
+func Redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
+// RedactValues returns a copy of values with every secret replaced.
+func RedactValues(values url.Values) url.Values {
+	redacted := url.Values{}
+	for key, list := range values {
+		for _, value := range list {
+			if secretParams[key] {
+				value = Redact(value)
+			}
+			redacted.Add(key, value)
+		}
+	}
+	return redacted
+}
+
+// redactURL returns u as a string with secrets in its query redacted.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	redacted.RawQuery = RedactValues(u.Query()).Encode()
+	return redacted.String()
+}
+
+// redactError removes secrets from the URL that net/http and net/url include
+// in the text of their errors, so that the error can be logged and shown.
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+			urlErr.URL = redactURL(u)
+		} else {
+			urlErr.URL = Redact(urlErr.URL)
+		}
+	}
+	return err
+}
+
+// do sends req with the shared HTTP client, tracing it when tracing is on.
+// Secrets are redacted from any error returned.
+func (api *API) do(req *http.Request) (*http.Response, error) {
+	if !api.tracing {
+		resp, err := api.client().Do(req)
+		return resp, redactError(err)
+	}
+
+	start := time.Now()
+	resp, err := api.client().Do(req)
+	err = redactError(err)
+	if err != nil {
+		log.Printf("TRACE method=%s url=%q sent=%d error=%q latency=%s\n", req.Method, redactURL(req.URL), req.ContentLength, err, time.Since(start))
+		return resp, err
+	}
+	resp.Body = &tracedBody{ReadCloser: resp.Body, req: req, resp: resp, start: start}
+	return resp, err
+}
+
+// tracedBody counts the bytes read from a response body and logs the
+// exchange when the body is closed.
+type tracedBody struct {
+	io.ReadCloser
+	req      *http.Request
+	resp     *http.Response
+	start    time.Time
+	received int64
+	logged   bool
+}
+
+func (b *tracedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.received += int64(n)
+	return
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.logged {
+		b.logged = true
+		log.Printf("TRACE method=%s url=%q status=%d sent=%d received=%d latency=%s\n", b.req.Method, redactURL(b.req.URL), b.resp.StatusCode, b.req.ContentLength, b.received, time.Since(b.start))
+	}
+	return err
+}
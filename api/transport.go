@@ -0,0 +1,194 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// TransportConfig controls the HTTP client shared by every API and Ruler
+// request.
+type TransportConfig struct {
+	// ProxyURL is an http, https or socks5 proxy URL. Credentials for an
+	// authenticating proxy go in the user info part of the URL. When blank the
+	// HTTP_PROXY/HTTPS_PROXY environment variables are used.
+	ProxyURL string
+	// CAFile is a PEM bundle of extra certificate authorities to trust in
+	// addition to the system pool.
+	CAFile                string
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+}
+
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		DialTimeout:           30 * time.Second,
+		KeepAlive:             30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 2 * time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          20,
+		MaxIdleConnsPerHost:   8,
+	}
+}
+
+// transportConfigFile is the on-disk form of TransportConfig. Durations are
+// written as strings such as "30s" or "2m".
+type transportConfigFile struct {
+	ProxyURL              string
+	CAFile                string
+	DialTimeout           string
+	KeepAlive             string
+	TLSHandshakeTimeout   string
+	ResponseHeaderTimeout string
+	IdleConnTimeout       string
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+}
+
+// LoadTransportConfig reads a JSON network configuration file on top of the
+// defaults. Values missing from the file keep their default.
+func LoadTransportConfig(path string) (config TransportConfig, err error) {
+	config = DefaultTransportConfig()
+
+	log.Println("Loading network configuration from:", path)
+
+	file, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Println("No network configuration file found, using defaults.")
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	var loaded transportConfigFile
+	err = json.Unmarshal(file, &loaded)
+	if err != nil {
+		err = errors.New(fmt.Sprintln("Could not parse network configuration file:", err))
+		return
+	}
+
+	if loaded.ProxyURL != "" {
+		config.ProxyURL = loaded.ProxyURL
+	}
+	if loaded.CAFile != "" {
+		config.CAFile = loaded.CAFile
+	}
+	if loaded.MaxIdleConns != 0 {
+		config.MaxIdleConns = loaded.MaxIdleConns
+	}
+	if loaded.MaxIdleConnsPerHost != 0 {
+		config.MaxIdleConnsPerHost = loaded.MaxIdleConnsPerHost
+	}
+
+	durations := []struct {
+		value string
+		dest  *time.Duration
+	}{
+		{loaded.DialTimeout, &config.DialTimeout},
+		{loaded.KeepAlive, &config.KeepAlive},
+		{loaded.TLSHandshakeTimeout, &config.TLSHandshakeTimeout},
+		{loaded.ResponseHeaderTimeout, &config.ResponseHeaderTimeout},
+		{loaded.IdleConnTimeout, &config.IdleConnTimeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		*d.dest, err = time.ParseDuration(d.value)
+		if err != nil {
+			err = errors.New(fmt.Sprintln("Invalid duration in network configuration file:", d.value))
+			return
+		}
+	}
+
+	return
+}
+
+// NewHTTPClient builds an http.Client from config. The client has no overall
+// timeout so that long Ruler uploads are not cut off; stalls are caught by the
+// dial, TLS and response header timeouts instead.
+func NewHTTPClient(config TransportConfig) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintln("Invalid proxy URL:", err))
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, errors.New(fmt.Sprintln("Unsupported proxy scheme:", proxyURL.Scheme))
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintln("Could not read CA file:", err))
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("CA file contains no usable certificates.")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		ForceAttemptHTTP2:     true,
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+var defaultHTTPClient *http.Client
+
+func init() {
+	defaultHTTPClient, _ = NewHTTPClient(DefaultTransportConfig())
+}
+
+// SetHTTPClient replaces the client used for every request made through api.
+func (api *API) SetHTTPClient(client *http.Client) {
+	api.httpClient = client
+}
+
+func (api *API) client() *http.Client {
+	if api.httpClient != nil {
+		return api.httpClient
+	}
+	return defaultHTTPClient
+}
@@ -0,0 +1,129 @@
+package api_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+)
+
+func writeTransportConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "network.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTransportConfigWithoutFile(t *testing.T) {
+	config, err := api.LoadTransportConfig(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != api.DefaultTransportConfig() {
+		t.Errorf("got %+v, want the defaults", config)
+	}
+}
+
+func TestLoadTransportConfigOverridesDefaults(t *testing.T) {
+	path := writeTransportConfig(t, `{"DialTimeout": "45s", "MaxIdleConns": 3, "ProxyURL": "http://proxy:3128"}`)
+
+	config, err := api.LoadTransportConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DialTimeout != 45*time.Second {
+		t.Errorf("DialTimeout is %s, want 45s", config.DialTimeout)
+	}
+	if config.MaxIdleConns != 3 {
+		t.Errorf("MaxIdleConns is %d, want 3", config.MaxIdleConns)
+	}
+	if config.ProxyURL != "http://proxy:3128" {
+		t.Errorf("ProxyURL is %q", config.ProxyURL)
+	}
+	defaults := api.DefaultTransportConfig()
+	if config.KeepAlive != defaults.KeepAlive || config.MaxIdleConnsPerHost != defaults.MaxIdleConnsPerHost {
+		t.Errorf("values missing from the file lost their defaults: %+v", config)
+	}
+}
+
+func TestLoadTransportConfigRejectsBadDuration(t *testing.T) {
+	path := writeTransportConfig(t, `{"IdleConnTimeout": "soon"}`)
+
+	if _, err := api.LoadTransportConfig(path); err == nil {
+		t.Error("invalid duration was accepted")
+	}
+}
+
+func TestNewHTTPClientRejectsUnsupportedProxy(t *testing.T) {
+	config := api.DefaultTransportConfig()
+	config.ProxyURL = "ftp://proxy:21"
+
+	if _, err := api.NewHTTPClient(config); err == nil {
+		t.Error("ftp proxy was accepted")
+	}
+}
+
+func TestNewHTTPClientUsesProxy(t *testing.T) {
+	var requested string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	config := api.DefaultTransportConfig()
+	config.ProxyURL = proxy.URL
+	client, err := api.NewHTTPClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := client.Get("http://api.picturelife.invalid/medias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if requested != "http://api.picturelife.invalid/medias" {
+		t.Errorf("proxy saw %q", requested)
+	}
+}
+
+func TestNewHTTPClientRejectsCAFileWithoutCertificates(t *testing.T) {
+	config := api.DefaultTransportConfig()
+	config.CAFile = writeTransportConfig(t, "not a certificate")
+
+	if _, err := api.NewHTTPClient(config); err == nil {
+		t.Error("CA file without certificates was accepted")
+	}
+}
+
+func TestNewHTTPClientTrustsCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	config := api.DefaultTransportConfig()
+	client, err := api.NewHTTPClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(server.URL); err == nil {
+		t.Fatal("untrusted certificate was accepted")
+	}
+
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	config.CAFile = writeTransportConfig(t, string(certificate))
+	client, err = api.NewHTTPClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+}
@@ -1,10 +1,11 @@
 package api
 
 import (
-	"fmt"
+	"context"
 	"github.com/deet/picturelife-experimental-uploader/util"
 	"log"
 	"net/url"
+	"strings"
 )
 
 type PendingMedia struct {
@@ -12,6 +13,7 @@ type PendingMedia struct {
 	Error              bool          `json:"error"`
 	ErrorData          []interface{} `json:"error_data"`
 	Id                 string        `json:"id"`
+	MediaId            string        `json:"media_id"`
 	MediaType          string        `json:"media_type"`
 	ProcessingComplete bool          `json:"processing_complete"`
 	Status             string        `json:"status"`
@@ -53,6 +55,7 @@ type Media struct {
 	Version          int
 	Visible          bool
 	Width            int
+	Signature        string
 }
 
 type MediasCreateResponse struct {
@@ -61,10 +64,23 @@ type MediasCreateResponse struct {
 	Media        Media        `json:"media"`
 }
 
+const defaultSignatureBatchSize = 100
+
+type PendingMediaResponse struct {
+	ApiResponse
+	PendingMedia PendingMedia `json:"pending_media"`
+	Media        Media        `json:"media"`
+}
+
 type NewMedia struct {
 	Signature  string
 	S3Location string
 	LocalPath  string
+	Caption    string
+	Keywords   []string
+	// RestartUpload discards any partial Ruler upload and sends the whole
+	// file again.
+	RestartUpload bool
 }
 
 type SignatureResponse struct {
@@ -78,47 +94,92 @@ type CheckSignatureReponse struct {
 	Signatures map[string]SignatureResponse
 }
 
-func (api *API) createMedia(newMedia NewMedia, force bool) (pendingMediaId, mediaId string, err error) {
+func (api *API) createMedia(ctx context.Context, newMedia NewMedia, force bool) (pendingMediaId, mediaId string, err error) {
 	params := url.Values{}
 	params.Add("signature", newMedia.Signature)
 	params.Add("url", newMedia.S3Location)
 	params.Add("local_path", newMedia.LocalPath)
+	if newMedia.Caption != "" {
+		params.Add("caption", newMedia.Caption)
+	}
+	// Each keyword is sent as its own value, since keywords can contain
+	// commas
+	for _, keyword := range newMedia.Keywords {
+		params.Add("tags[]", keyword)
+	}
 	if force {
 		params.Add("force", "true")
 	}
 
 	response := new(MediasCreateResponse)
-	api.CallAndParseIntoWithOutput("medias/create", params, response, false)
+	_, err = api.CallAndParseIntoWithOutputContext(ctx, "medias/create", params, response, false)
+	if err != nil {
+		return
+	}
 
 	mediaId = response.Media.Id
 	pendingMediaId = response.PendingMedia.Id
 	return
 }
 
+func (api *API) GetPendingMedia(pendingMediaId string) (pendingMedia PendingMedia, media Media, err error) {
+	return api.GetPendingMediaContext(context.Background(), pendingMediaId)
+}
+
+// GetPendingMediaContext fetches the processing status of an upload. Once
+// ProcessingComplete is set, media holds the finished media unless Error is
+// set.
+func (api *API) GetPendingMediaContext(ctx context.Context, pendingMediaId string) (pendingMedia PendingMedia, media Media, err error) {
+	params := url.Values{}
+	params.Add("id", pendingMediaId)
+
+	response := new(PendingMediaResponse)
+	_, err = api.CallAndParseIntoWithOutputContext(ctx, "pending_medias/show", params, response, false)
+	if err != nil {
+		return
+	}
+
+	pendingMedia = response.PendingMedia
+	media = response.Media
+	if pendingMedia.MediaId == "" {
+		pendingMedia.MediaId = media.Id
+	}
+	return
+}
+
 func (api *API) Upload(filePath, sig string) (pendingMediaId, mediaId string, deleted bool, err error) {
 	return api.UploadForce(filePath, sig, false)
 }
 
+func (api *API) UploadContext(ctx context.Context, filePath, sig string) (pendingMediaId, mediaId string, deleted bool, err error) {
+	return api.UploadForceContext(ctx, filePath, sig, false)
+}
+
 func (api *API) UploadForce(filePath, sig string, force bool) (pendingMediaId, mediaId string, deleted bool, err error) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("Upload error:", err)
-		}
-	}()
+	return api.UploadForceContext(context.Background(), filePath, sig, force)
+}
 
-	var newMedia NewMedia
-	newMedia.LocalPath = filePath
+func (api *API) UploadForceContext(ctx context.Context, filePath, sig string, force bool) (pendingMediaId, mediaId string, deleted bool, err error) {
+	return api.UploadMediaContext(ctx, NewMedia{LocalPath: filePath, Signature: sig}, force)
+}
 
+// UploadMediaContext uploads the file at newMedia.LocalPath and creates a
+// media from it with the caption and keywords of newMedia. S3Location is
+// filled in by the upload, and a blank Signature is calculated. The caption
+// and keywords are only sent when a new media is created, which is when
+// pendingMediaId is set.
+func (api *API) UploadMediaContext(ctx context.Context, newMedia NewMedia, force bool) (pendingMediaId, mediaId string, deleted bool, err error) {
+	filePath := newMedia.LocalPath
+	sig := newMedia.Signature
 	if sig == "" {
 		newMedia.Signature = util.CalculateSignature(filePath)
-	} else {
-		newMedia.Signature = sig
 	}
 
-	existingSignatures, err := api.CheckSignature(newMedia.Signature)
+	existingSignatures, err := api.CheckSignatureContext(ctx, newMedia.Signature)
 	//log.Println("check sig done")
 	if err != nil {
-		panic("Could not check signature")
+		log.Println("Could not check signature:", err)
+		return
 	}
 	// If there's an existing, non-deleted media there's no need to upload
 	existingDeleted := false
@@ -142,20 +203,19 @@ func (api *API) UploadForce(filePath, sig string, force bool) (pendingMediaId, m
 	}
 	//log.Println("passed sig check")
 
-	restartRulerUpload := force
-	newMedia.S3Location, _, err = api.rulerUpload(filePath, sig, restartRulerUpload)
-	if newMedia.S3Location == "" {
-		panic("Ruler upload failed (location missing)")
-	}
+	restartRulerUpload := force || newMedia.RestartUpload
+	newMedia.S3Location, _, err = api.rulerUpload(ctx, filePath, sig, restartRulerUpload)
 	if err != nil {
-		panic(err)
+		log.Println("Ruler upload failed:", err)
+		return
 	}
 
 	//log.Println("Creating media from RULER upload.")
 
-	pendingMediaId, mediaId, err = api.createMedia(newMedia, force)
+	pendingMediaId, mediaId, err = api.createMedia(ctx, newMedia, force)
 	if err != nil {
-		panic(fmt.Sprintln("medias/create error", err))
+		log.Println("medias/create error", err)
+		return
 	}
 
 	if mediaId != "" {
@@ -171,15 +231,59 @@ func (api *API) UploadForce(filePath, sig string, force bool) (pendingMediaId, m
 }
 
 func (api *API) CheckSignature(sig string) (responses map[string]SignatureResponse, err error) {
-	params := url.Values{}
-	params.Add("signatures", sig) // param can actually be send as CSV list
+	return api.CheckSignatureContext(context.Background(), sig)
+}
+
+func (api *API) CheckSignatureContext(ctx context.Context, sig string) (responses map[string]SignatureResponse, err error) {
+	return api.CheckSignaturesContext(ctx, []string{sig})
+}
 
-	response := new(CheckSignatureReponse)
-	api.CallAndParseIntoWithOutput("medias/check_signatures", params, response, false)
+func (api *API) CheckSignatures(sigs []string) (responses map[string]SignatureResponse, err error) {
+	return api.CheckSignaturesContext(context.Background(), sigs)
+}
+
+// CheckSignaturesContext looks up many signatures at once, sending them in
+// batches of at most SignatureBatchSize. The returned map is keyed by
+// signature; signatures unknown to the server may be missing or have an empty
+// MediaId.
+func (api *API) CheckSignaturesContext(ctx context.Context, sigs []string) (responses map[string]SignatureResponse, err error) {
+	responses = make(map[string]SignatureResponse)
+	batchSize := api.SignatureBatchSize()
 
-	//log.Println("done with call")
+	for start := 0; start < len(sigs); start += batchSize {
+		end := start + batchSize
+		if end > len(sigs) {
+			end = len(sigs)
+		}
 
-	responses = response.Signatures
+		params := url.Values{}
+		params.Add("signatures", strings.Join(sigs[start:end], ","))
+
+		response := new(CheckSignatureReponse)
+		_, err = api.CallAndParseIntoWithOutputContext(ctx, "medias/check_signatures", params, response, false)
+		if err != nil {
+			return
+		}
+
+		//log.Println("done with call")
+
+		for sig, sigResponse := range response.Signatures {
+			responses[sig] = sigResponse
+		}
+	}
 
 	return
 }
+
+// SetSignatureBatchSize sets how many signatures are sent in a single
+// medias/check_signatures call.
+func (api *API) SetSignatureBatchSize(size int) {
+	api.signatureBatchSize = size
+}
+
+func (api *API) SignatureBatchSize() int {
+	if api.signatureBatchSize > 0 {
+		return api.signatureBatchSize
+	}
+	return defaultSignatureBatchSize
+}
@@ -0,0 +1,23 @@
+package api_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+)
+
+func TestUploadSendsKeywordsWithCommas(t *testing.T) {
+	s, a := newFakeAPI(t)
+	path, sig := writeMedia(t, 1000)
+	keywords := []string{"Smith, John", "beach"}
+
+	_, _, _, err := a.UploadMediaContext(context.Background(), api.NewMedia{LocalPath: path, Signature: sig, Caption: "Summer", Keywords: keywords}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := s.MediaTags(sig); !reflect.DeepEqual(tags, keywords) {
+		t.Errorf("server received tags %q, want %q", tags, keywords)
+	}
+}
@@ -0,0 +1,216 @@
+package credentials
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	keySize          = 32
+	saltSize         = 16
+	pbkdf2Iterations = 600000
+)
+
+// FileStore keeps secrets in a file encrypted with AES-256-GCM. The key is
+// derived from a passphrase when one is given. Otherwise a random machine key
+// is created in the user's configuration directory, which keeps the secrets
+// safe when the data directory is copied or backed up, but not from other
+// programs run by the same user.
+type FileStore struct {
+	path       string
+	passphrase string
+	lock       sync.Mutex
+	key        []byte // cached key, derived with keySalt
+	keySalt    []byte
+}
+
+// encryptedFile is the on-disk form of a FileStore.
+type encryptedFile struct {
+	Version    int
+	Salt       []byte // for the passphrase key derivation
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func NewFileStore(path, passphrase string) *FileStore {
+	return &FileStore{path: path, passphrase: passphrase}
+}
+
+func (s *FileStore) Get(name string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	secrets, _, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	secret, ok := secrets[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return secret, nil
+}
+
+func (s *FileStore) Set(name string, secret []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	secrets, salt, err := s.read()
+	if err != nil {
+		return err
+	}
+	secrets[name] = secret
+	return s.write(secrets, salt)
+}
+
+func (s *FileStore) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	secrets, salt, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[name]; !ok {
+		return nil
+	}
+	delete(secrets, name)
+	return s.write(secrets, salt)
+}
+
+// read decrypts the store. A missing file is an empty store.
+func (s *FileStore) read() (secrets map[string][]byte, salt []byte, err error) {
+	secrets = make(map[string][]byte)
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return secrets, nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	var file encryptedFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return
+	}
+	salt = file.Salt
+
+	gcm, err := s.cipher(salt)
+	if err != nil {
+		return
+	}
+	plaintext, err := gcm.Open(nil, file.Nonce, file.Ciphertext, nil)
+	if err != nil {
+		err = errors.New("Could not decrypt credentials. Is the passphrase right?")
+		return
+	}
+	err = json.Unmarshal(plaintext, &secrets)
+	return
+}
+
+func (s *FileStore) write(secrets map[string][]byte, salt []byte) error {
+	if salt == nil {
+		salt = make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+	}
+	gcm, err := s.cipher(salt)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	data, err := json.Marshal(encryptedFile{
+		Version:    1,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, nil),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated
+	// store behind
+	tmpPath := s.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err == nil {
+		// A temporary file left behind may have been created with another
+		// mode, which WriteFile keeps
+		err = os.Chmod(tmpPath, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+func (s *FileStore) cipher(salt []byte) (cipher.AEAD, error) {
+	// Deriving the key is deliberately slow, so it is only done again when
+	// the salt changes
+	if s.key == nil || !bytes.Equal(s.keySalt, salt) {
+		var key []byte
+		var err error
+		if s.passphrase != "" {
+			key, err = pbkdf2.Key(sha256.New, s.passphrase, salt, pbkdf2Iterations, keySize)
+		} else {
+			key, err = machineKey()
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.key, s.keySalt = key, salt
+	}
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// machineKey returns the random key kept in the user's configuration
+// directory, creating it the first time.
+func machineKey() ([]byte, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "picturelife-uploader", "credentials.key")
+
+	key, err := ioutil.ReadFile(path)
+	if err == nil && len(key) == keySize {
+		return key, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, keySize)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,71 @@
+package credentials
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	store := NewFileStore(path, "passphrase")
+
+	if _, err := store.Get("token"); err != ErrNotFound {
+		t.Fatalf("Get from an empty store returned %v, want ErrNotFound", err)
+	}
+	if err := store.Set("token", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new store reads what the first one wrote
+	secret, err := NewFileStore(path, "passphrase").Get("token")
+	if err != nil || string(secret) != "secret" {
+		t.Fatalf("Get returned %q, %v", secret, err)
+	}
+
+	if err := store.Delete("token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("token"); err != ErrNotFound {
+		t.Errorf("Get after Delete returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestFileStoreIsEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := NewFileStore(path, "passphrase").Set("token", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("secret is stored in plain text")
+	}
+	if _, err := NewFileStore(path, "wrong").Get("token"); err == nil {
+		t.Error("Get with the wrong passphrase succeeded")
+	}
+}
+
+func TestFileStoreIsPrivate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	// A temporary file left behind by an earlier write
+	if err := ioutil.WriteFile(path+".tmp", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewFileStore(path, "passphrase").Set("token", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("credentials file has mode %o, want 600", mode)
+	}
+}
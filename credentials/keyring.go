@@ -0,0 +1,67 @@
+package credentials
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const keyringService = "picturelife-uploader"
+
+// KeyringStore keeps secrets in the desktop keyring through the Secret
+// Service API, using the secret-tool command from libsecret.
+type KeyringStore struct {
+	tool string
+}
+
+// NewKeyringStore returns a KeyringStore, or an error if no Secret Service
+// keyring can be reached.
+func NewKeyringStore() (*KeyringStore, error) {
+	tool, err := exec.LookPath("secret-tool")
+	if err != nil {
+		return nil, errors.New("The keyring credential store needs secret-tool (libsecret) to be installed.")
+	}
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return nil, errors.New("The keyring credential store needs a desktop session (no D-Bus session bus found).")
+	}
+	return &KeyringStore{tool: tool}, nil
+}
+
+func (s *KeyringStore) Get(name string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(s.tool, "lookup", "service", keyringService, "account", name)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	// secret-tool exits with status 1 and no output when nothing is stored
+	if stdout.Len() == 0 && stderr.Len() == 0 {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.New("secret-tool lookup failed: " + strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func (s *KeyringStore) Set(name string, secret []byte) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(s.tool, "store", "--label=Picturelife uploader "+name, "service", keyringService, "account", name)
+	cmd.Stdin = bytes.NewReader(secret)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New("secret-tool store failed: " + strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (s *KeyringStore) Delete(name string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(s.tool, "clear", "service", keyringService, "account", name)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil && stderr.Len() > 0 {
+		return errors.New("secret-tool clear failed: " + strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Package credentials keeps secrets such as access tokens out of the
+// plaintext state files. A Store holds named secrets in a backend: an
+// encrypted file, or the desktop keyring where one is available.
+package credentials
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned by Get when no secret is stored under the name.
+var ErrNotFound = errors.New("Credentials not found.")
+
+type Store interface {
+	// Get returns the secret stored under name, or ErrNotFound.
+	Get(name string) ([]byte, error)
+	// Set stores secret under name, replacing any earlier secret.
+	Set(name string, secret []byte) error
+	// Delete removes the secret stored under name, if any.
+	Delete(name string) error
+}
+
+// Open returns the store for backend: "file" for an encrypted file at path,
+// or "keyring" for the Secret Service keyring. passphrase is only used by the
+// file backend; see NewFileStore.
+func Open(backend, path, passphrase string) (Store, error) {
+	switch backend {
+	case "", "file":
+		return NewFileStore(path, passphrase), nil
+	case "keyring":
+		return NewKeyringStore()
+	}
+	return nil, fmt.Errorf("Unknown credential store %s.", backend)
+}
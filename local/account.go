@@ -0,0 +1,202 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Account is a Picturelife account used alongside the default one. Files
+// uploaded from directories assigned to an account are checked and uploaded
+// with its access token, and tracked separately in the library: a file
+// uploaded to one account still counts as pending for another.
+type Account struct {
+	Name        string
+	AccessToken api.AccessToken
+	api         *api.API
+	expired     bool // the access token stopped working
+}
+
+// AccountStatus describes an account for the web UI. The default account has
+// an empty Name.
+type AccountStatus struct {
+	Name     string
+	Email    string
+	LoggedIn bool
+	Expired  bool // logged in before, but the access token stopped working
+}
+
+// FileKey returns the key of the file with the given signature in the library
+// of account. Files of the default account are keyed by signature alone.
+func FileKey(account, signature string) string {
+	if account == "" {
+		return signature
+	}
+	return account + "/" + signature
+}
+
+// Key returns the key of the file in State.Files.
+func (f *File) Key() string {
+	return FileKey(f.Account, f.Signature)
+}
+
+// apiFor returns the API client for account. Accounts share the connection
+// settings of the default client but have their own access token.
+func (state *State) apiFor(account string) *api.API {
+	if account == "" {
+		return &state.Api
+	}
+	state.accountsLock.Lock()
+	defer state.accountsLock.Unlock()
+	acc, ok := state.Accounts[account]
+	if !ok {
+		// Directories of a removed account upload with no token, which
+		// fails as unauthorized rather than going to the wrong account
+		acc = &Account{Name: account}
+	}
+	if acc.api == nil {
+		accountApi := state.Api.WithToken(acc.AccessToken)
+		accountApi.SetTokenRefreshHandler(func(token api.AccessToken) {
+			state.accountsLock.Lock()
+			acc.AccessToken = token
+			state.accountsLock.Unlock()
+			state.Save()
+		})
+		acc.api = accountApi
+	}
+	return acc.api
+}
+
+// accountFor returns the account a file at path is uploaded to, according to
+// the watched directory that contains it. The innermost directory with an
+// account wins. An empty name is the default account.
+func (state *State) accountFor(path string) string {
+	state.directoriesLock.RLock()
+	defer state.directoriesLock.RUnlock()
+	var match LocalDirectory
+	for dirPath, directory := range state.Directories {
+		if directory.Account == "" {
+			continue
+		}
+		if !strings.HasPrefix(path, dirPath+string(filepath.Separator)) {
+			continue
+		}
+		if len(dirPath) > len(match.Path) {
+			match = directory
+		}
+	}
+	return match.Account
+}
+
+// AddAccount logs in to Picturelife as another account and saves it as name.
+// Logging in to an existing account again replaces its token.
+func (state *State) AddAccount(ctx context.Context, name, email, password string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return errors.New("Account name is required and cannot contain /.")
+	}
+	if email == "" || password == "" {
+		return errors.New("Email and password are required.")
+	}
+
+	loginApi := state.Api.WithToken(api.AccessToken{})
+	token, err := loginApi.LoginContext(ctx, email, password)
+	if err != nil {
+		return err
+	}
+
+	state.accountsLock.Lock()
+	if state.Accounts == nil {
+		state.Accounts = make(map[string]*Account)
+	}
+	acc, ok := state.Accounts[name]
+	if !ok {
+		acc = &Account{Name: name}
+		state.Accounts[name] = acc
+	}
+	acc.AccessToken = token
+	acc.expired = false
+	if acc.api != nil {
+		acc.api.SetToken(token)
+	}
+	state.accountsLock.Unlock()
+
+	state.Save()
+	log.Println("Logged in to account", name, "as", token.Email)
+	state.resumeAfterLogin(name)
+	return nil
+}
+
+// RemoveAccount forgets the account called name and its access token. It
+// fails while a directory is still assigned to the account.
+func (state *State) RemoveAccount(name string) error {
+	// Hold the directories so that none is assigned to the account while it
+	// is removed
+	state.directoriesLock.RLock()
+	for _, directory := range state.Directories {
+		if directory.Account == name {
+			state.directoriesLock.RUnlock()
+			return errors.New("Account is still used by " + directory.Path + ".")
+		}
+	}
+	state.accountsLock.Lock()
+	_, ok := state.Accounts[name]
+	delete(state.Accounts, name)
+	state.accountsLock.Unlock()
+	state.directoriesLock.RUnlock()
+	if !ok {
+		return errors.New("Account not found.")
+	}
+	state.Save()
+	log.Println("Removed account", name)
+	return nil
+}
+
+// ListAccounts returns the default account followed by the other accounts in
+// name order.
+func (state *State) ListAccounts() []AccountStatus {
+	session := state.SessionStatus()
+	accounts := []AccountStatus{{Email: session.Email, LoggedIn: session.LoggedIn}}
+
+	state.accountsLock.Lock()
+	defer state.accountsLock.Unlock()
+	names := []string{}
+	for name := range state.Accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		acc := state.Accounts[name]
+		accounts = append(accounts, AccountStatus{
+			Name:     name,
+			Email:    acc.AccessToken.Email,
+			LoggedIn: acc.AccessToken.Token != "" && !acc.expired,
+			Expired:  acc.expired,
+		})
+	}
+	return accounts
+}
+
+// SetDirectoryAccount sets the account that files in the directory at path
+// are uploaded to. An empty name is the default account.
+func (state *State) SetDirectoryAccount(path, account string) error {
+	directory, ok := state.GetDirectory(path)
+	if !ok {
+		return errors.New("Directory not found.")
+	}
+	if account != "" {
+		state.accountsLock.Lock()
+		_, exists := state.Accounts[account]
+		state.accountsLock.Unlock()
+		if !exists {
+			return errors.New("Account not found.")
+		}
+	}
+	directory.Account = account
+	state.SetDirectory(directory)
+	state.Save()
+	return nil
+}
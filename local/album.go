@@ -0,0 +1,139 @@
+package local
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// albumFor returns the album a file at path should be added to, according to
+// the watched directory that contains it. The innermost directory with an
+// album setting wins. An empty name means no album.
+func (state *State) albumFor(path string) string {
+	state.directoriesLock.RLock()
+	defer state.directoriesLock.RUnlock()
+	var match LocalDirectory
+	for dirPath, directory := range state.Directories {
+		if directory.Album == "" && !directory.AlbumFromFolder {
+			continue
+		}
+		if !strings.HasPrefix(path, dirPath+string(filepath.Separator)) {
+			continue
+		}
+		if len(dirPath) > len(match.Path) {
+			match = directory
+		}
+	}
+	if match.AlbumFromFolder {
+		return filepath.Base(filepath.Dir(path))
+	}
+	return match.Album
+}
+
+// albumId returns the ID of the album called name in account, creating the
+// album if the account does not have one yet.
+func (state *State) albumId(ctx context.Context, account, name string) (id string, err error) {
+	state.albumsLock.Lock()
+	defer state.albumsLock.Unlock()
+
+	// Album names are only unique within an account
+	if id, ok := state.albumIds[FileKey(account, name)]; ok {
+		return id, nil
+	}
+
+	accountApi := state.apiFor(account)
+	albums, err := accountApi.ListAlbumsContext(ctx)
+	if err != nil {
+		return
+	}
+	for _, album := range albums {
+		state.albumIds[FileKey(account, album.Name)] = album.Id
+	}
+	if id, ok := state.albumIds[FileKey(account, name)]; ok {
+		return id, nil
+	}
+
+	log.Println("Creating album", name)
+	album, err := accountApi.CreateAlbumContext(ctx, name)
+	if err != nil {
+		return
+	}
+	state.albumIds[FileKey(account, album.Name)] = album.Id
+	id = album.Id
+	return
+}
+
+// assignAlbum adds the media of file to its album. A failure leaves the file
+// unassigned so that assignPendingAlbums tries again later; the upload itself
+// is unaffected.
+func (state *State) assignAlbum(ctx context.Context, file File) File {
+	if file.Album == "" || file.AlbumAdded || file.MediaId == "" || file.Status != "uploaded" {
+		return file
+	}
+
+	id, err := state.albumId(ctx, file.Account, file.Album)
+	if err == nil {
+		err = state.apiFor(file.Account).AddMediaToAlbumContext(ctx, id, []string{file.MediaId})
+	}
+	if err != nil {
+		log.Println("Could not add", file.Path, "to album", file.Album, err)
+		return file
+	}
+
+	log.Printf("File (%s) added to album %s\n", file.Path, file.Album)
+	file.AlbumAdded = true
+	return file
+}
+
+// assignPendingAlbums retries adding processed files to their albums.
+func (state *State) assignPendingAlbums(ctx context.Context) {
+	pending := state.FindFiles(func(file File) bool {
+		return file.Album != "" && !file.AlbumAdded && file.MediaId != "" && file.Status == "uploaded"
+	})
+
+	changed := false
+	for _, file := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		if !state.accountLoggedIn(file.Account) {
+			continue
+		}
+		file = state.assignAlbum(ctx, file)
+		if !file.AlbumAdded {
+			continue
+		}
+		updated := state.updateFile(file.Key(), func(current *File) bool {
+			// Leave files that were uploaded again or moved to another
+			// album while the server was being asked
+			if current.MediaId != file.MediaId || current.Album != file.Album {
+				return false
+			}
+			current.AlbumAdded = true
+			return true
+		})
+		if updated {
+			changed = true
+		}
+	}
+
+	if changed {
+		state.Save()
+	}
+}
+
+// SetDirectoryAlbum sets the album that files uploaded from the directory at
+// path are added to. album names a fixed album; fromFolder uses the name of
+// the folder each file is in instead. Both blank turns albums off.
+func (state *State) SetDirectoryAlbum(path, album string, fromFolder bool) bool {
+	directory, ok := state.GetDirectory(path)
+	if !ok {
+		return false
+	}
+	directory.Album = album
+	directory.AlbumFromFolder = fromFolder
+	state.SetDirectory(directory)
+	state.Save()
+	return true
+}
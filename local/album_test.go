@@ -0,0 +1,63 @@
+package local
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/deet/picturelife-experimental-uploader/api/apitest"
+)
+
+func TestAssignPendingAlbumsKeepsConcurrentChanges(t *testing.T) {
+	s, state := newFakeState(t)
+	mediaId := s.AddMedia("sig", false)
+	state.SetFile(File{Signature: "sig", Path: "photo.JPG", Status: "uploaded", MediaId: mediaId, Album: "Trips"})
+	s.Fail(apitest.Failure{Path: "albums/add_media", Times: 1, Delay: 100 * time.Millisecond})
+
+	done := make(chan struct{})
+	go func() {
+		state.assignPendingAlbums(context.Background())
+		close(done)
+	}()
+	waitForCall(t, s, "albums/add_media")
+	state.updateFile("sig", func(file *File) bool {
+		file.Record("Changed while the album was being set")
+		return true
+	})
+	<-done
+
+	file, _ := state.GetFile("sig")
+	if !file.AlbumAdded {
+		t.Error("album was not recorded")
+	}
+	if len(file.History) == 0 {
+		t.Error("history added while the album was being set was lost")
+	}
+	if media, _ := s.AlbumMedia("Trips"); len(media) != 1 || media[0] != mediaId {
+		t.Errorf("album holds %v", media)
+	}
+}
+
+func TestAssignPendingAlbumsSkipsFileUploadedAgain(t *testing.T) {
+	s, state := newFakeState(t)
+	mediaId := s.AddMedia("sig", false)
+	state.SetFile(File{Signature: "sig", Path: "photo.JPG", Status: "uploaded", MediaId: mediaId, Album: "Trips"})
+	s.Fail(apitest.Failure{Path: "albums/add_media", Times: 1, Delay: 100 * time.Millisecond})
+
+	done := make(chan struct{})
+	go func() {
+		state.assignPendingAlbums(context.Background())
+		close(done)
+	}()
+	waitForCall(t, s, "albums/add_media")
+	state.updateFile("sig", func(file *File) bool {
+		file.Status = "retrying"
+		file.MediaId = ""
+		return true
+	})
+	<-done
+
+	if file, _ := state.GetFile("sig"); file.Status != "retrying" || file.AlbumAdded {
+		t.Errorf("file uploaded again is %+v", file)
+	}
+}
@@ -1,11 +1,15 @@
 package local
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/deet/picturelife-experimental-uploader/api"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -42,6 +46,19 @@ type SettingsData struct {
 	ImageExtensions []string `json:"Image extensions"`
 	RawExtensions   []string `json:"RAW extensions"`
 	VideoExtensions []string `json:"Video extensions"`
+	BandwidthLimit  int64    `json:"Bandwidth limit (bytes/s)"`
+}
+
+type StatusData struct {
+	Schedule         ScheduleStatus
+	CredentialsError string `json:",omitempty"`
+}
+
+func (state *State) StatusData() StatusData {
+	return StatusData{
+		Schedule:         state.ScheduleStatus(),
+		CredentialsError: state.CredentialsError(),
+	}
 }
 
 func (state *State) AcceptRequestsFromController() {
@@ -58,9 +75,63 @@ func (state *State) AcceptRequestsFromController() {
 		case "retryUpload":
 			wg.Add(1)
 			go state.retryUpload(wg, request)
+		case "cancelUpload":
+			wg.Add(1)
+			go state.cancelUpload(wg, request)
+		case "getRemoteMedia":
+			wg.Add(1)
+			go state.getRemoteMedia(wg, request)
+		case "syncRemoteMedia":
+			wg.Add(1)
+			go state.syncRemoteMedia(wg, request)
+		case "reconcile":
+			wg.Add(1)
+			go state.reconcile(wg, request)
+		case "restore":
+			wg.Add(1)
+			go state.restore(wg, request)
+		case "setDirectoryAlbum":
+			wg.Add(1)
+			go state.setDirectoryAlbum(wg, request)
+		case "login":
+			wg.Add(1)
+			go state.login(wg, request)
+		case "browserLogin":
+			wg.Add(1)
+			go state.browserLogin(wg, request)
+		case "logout":
+			wg.Add(1)
+			go state.logout(wg, request)
+		case "sessionStatus":
+			wg.Add(1)
+			go state.sessionStatus(wg, request)
+		case "listAccounts":
+			wg.Add(1)
+			go state.listAccounts(wg, request)
+		case "addAccount":
+			wg.Add(1)
+			go state.addAccount(wg, request)
+		case "removeAccount":
+			wg.Add(1)
+			go state.removeAccount(wg, request)
+		case "setDirectoryAccount":
+			wg.Add(1)
+			go state.setDirectoryAccount(wg, request)
 		case "listSettings":
 			wg.Add(1)
 			go state.listSettings(wg, request)
+		case "setBandwidthLimit":
+			wg.Add(1)
+			go state.setBandwidthLimit(wg, request)
+		case "getStatus":
+			wg.Add(1)
+			go state.getStatus(wg, request)
+		case "getSchedule":
+			wg.Add(1)
+			go state.getSchedule(wg, request)
+		case "setSchedule":
+			wg.Add(1)
+			go state.setSchedule(wg, request)
 		case "getLocalFiles":
 			wg.Add(1)
 			go state.getLocalFiles(wg, request)
@@ -91,11 +162,11 @@ func (state *State) AcceptRequestsFromController() {
 func (s *State) retryUpload(wg sync.WaitGroup, r Request) {
 	defer func() { wg.Done() }()
 
-	sig := r.Data
+	key := r.Data
 
-	//log.Println("in retryUpload for sig", sig)
+	//log.Println("in retryUpload for key", key)
 
-	existingFile, ok := s.Files[sig]
+	existingFile, ok := s.GetFile(key)
 	if !ok {
 		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "Could not find file to retry in local library."}
 		return
@@ -112,6 +183,282 @@ func (s *State) retryUpload(wg sync.WaitGroup, r Request) {
 	return
 }
 
+func (s *State) cancelUpload(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	key := r.Data
+
+	if !s.CancelUpload(key) {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "File is not currently uploading."}
+		return
+	}
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = "Cancel command received."
+	r.ResponseChan <- response
+	return
+}
+
+func (s *State) getRemoteMedia(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	key := r.Data
+
+	file, ok := s.GetFile(key)
+	if !ok || file.MediaId == "" {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "File has not been uploaded."}
+		return
+	}
+
+	media, ok := s.GetRemoteMedia(file.Account, file.MediaId)
+	if !ok {
+		var err error
+		media, err = s.FetchRemoteMedia(context.Background(), file.Account, file.MediaId)
+		if err != nil {
+			r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "Could not fetch media."}
+			return
+		}
+	}
+
+	r.ResponseChan <- Response{Type: "Response", RequestId: r.Id, Data: media}
+	return
+}
+
+func (s *State) syncRemoteMedia(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	// The request data names the account; empty is the default account
+	count, err := s.SyncRemoteMedia(context.Background(), r.Data)
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "Could not list remote media."}
+		return
+	}
+
+	r.ResponseChan <- Response{Type: "Response", RequestId: r.Id, Data: count}
+	return
+}
+
+type ReconcileData struct {
+	Checked int
+	Changed int
+}
+
+func (s *State) reconcile(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	checked, changed, err := s.Reconcile(context.Background())
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "Could not reconcile with the server."}
+		return
+	}
+
+	r.ResponseChan <- Response{Type: "Response", RequestId: r.Id, Data: ReconcileData{Checked: checked, Changed: changed}}
+	return
+}
+
+func (s *State) restore(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	dir := r.Data
+	if dir == "" {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "A directory to restore into is required."}
+		return
+	}
+
+	result, err := s.Restore(context.Background(), dir)
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: err.Error()}
+		return
+	}
+
+	r.ResponseChan <- Response{Type: "Response", RequestId: r.Id, Data: result}
+	return
+}
+
+type DirectoryAlbumData struct {
+	Path            string
+	Album           string
+	AlbumFromFolder bool
+}
+
+func (s *State) setDirectoryAlbum(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	var data DirectoryAlbumData
+	err := json.Unmarshal([]byte(r.Data), &data)
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "Album setting must be a JSON object with Path, Album and AlbumFromFolder."}
+		return
+	}
+
+	if !s.SetDirectoryAlbum(data.Path, data.Album, data.AlbumFromFolder) {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "Directory not found."}
+		return
+	}
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = "Album set."
+	r.ResponseChan <- response
+	return
+}
+
+type LoginData struct {
+	Email    string
+	Password string
+}
+
+func (s *State) login(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	var data LoginData
+	err := json.Unmarshal([]byte(r.Data), &data)
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "Login must be a JSON object with Email and Password."}
+		return
+	}
+
+	err = s.Login(context.Background(), data.Email, data.Password)
+	if err != nil {
+		message := "Login failed."
+		if api.IsUnauthorized(err) {
+			message = "Login failed: wrong email or password."
+		}
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: message}
+		return
+	}
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = s.SessionStatus()
+	r.ResponseChan <- response
+	return
+}
+
+type BrowserLoginData struct {
+	AuthorizeURL string
+}
+
+// browserLogin answers with the address of the Picturelife login page, which
+// the web client opens itself so that it does not have to run on the same
+// machine as the uploader. The outcome arrives later as a sessionUpdate or
+// browserLoginFailed event.
+func (s *State) browserLogin(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	authorizeURL, err := s.StartBrowserLogin(context.Background())
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: err.Error()}
+		return
+	}
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = BrowserLoginData{AuthorizeURL: authorizeURL}
+	r.ResponseChan <- response
+	return
+}
+
+func (s *State) logout(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	s.Logout()
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = s.SessionStatus()
+	r.ResponseChan <- response
+	return
+}
+
+func (s *State) sessionStatus(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = s.SessionStatus()
+	r.ResponseChan <- response
+	return
+}
+
+func (s *State) listAccounts(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = s.ListAccounts()
+	r.ResponseChan <- response
+	return
+}
+
+type AccountData struct {
+	Name     string
+	Email    string
+	Password string
+}
+
+func (s *State) addAccount(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	var data AccountData
+	err := json.Unmarshal([]byte(r.Data), &data)
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "Account must be a JSON object with Name, Email and Password."}
+		return
+	}
+
+	err = s.AddAccount(context.Background(), data.Name, data.Email, data.Password)
+	if err != nil {
+		message := err.Error()
+		if api.IsUnauthorized(err) {
+			message = "Login failed: wrong email or password."
+		}
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: message}
+		return
+	}
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = s.ListAccounts()
+	r.ResponseChan <- response
+	return
+}
+
+func (s *State) removeAccount(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	err := s.RemoveAccount(r.Data)
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: err.Error()}
+		return
+	}
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = s.ListAccounts()
+	r.ResponseChan <- response
+	return
+}
+
+type DirectoryAccountData struct {
+	Path    string
+	Account string
+}
+
+func (s *State) setDirectoryAccount(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	var data DirectoryAccountData
+	err := json.Unmarshal([]byte(r.Data), &data)
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "Account setting must be a JSON object with Path and Account."}
+		return
+	}
+
+	err = s.SetDirectoryAccount(data.Path, data.Account)
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: err.Error()}
+		return
+	}
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = "Account set."
+	r.ResponseChan <- response
+	return
+}
+
 func (s *State) getDirectoryContents(wg sync.WaitGroup, r Request) {
 	defer func() { wg.Done() }()
 
@@ -196,7 +543,7 @@ func (s *State) getLocalDirectories(wg sync.WaitGroup, r Request) {
 
 	rd := []LocalDirectory{}
 
-	for _, localDir := range s.Directories {
+	for _, localDir := range s.directoryList() {
 		rd = append(rd, localDir)
 	}
 
@@ -215,6 +562,7 @@ func (s *State) ToSettingsData() SettingsData {
 		ImageExtensions: s.ImageExtensions,
 		RawExtensions:   s.RawExtensions,
 		VideoExtensions: s.VideoExtensions,
+		BandwidthLimit:  s.BandwidthLimit,
 	}
 }
 
@@ -228,15 +576,74 @@ func (s *State) listSettings(wg sync.WaitGroup, r Request) {
 	return
 }
 
-func (s *State) getLocalFiles(wg sync.WaitGroup, r Request) {
+func (s *State) setBandwidthLimit(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	limit, err := strconv.ParseInt(strings.TrimSpace(r.Data), 10, 64)
+	if err != nil || limit < 0 {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "Bandwidth limit must be a number of bytes per second (0 for no limit)."}
+		return
+	}
+
+	s.SetBandwidthLimit(limit)
+	s.Save()
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = s.ToSettingsData()
+	r.ResponseChan <- response
+
+	return
+}
+
+func (s *State) getStatus(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = s.StatusData()
+	r.ResponseChan <- response
+
+	return
+}
+
+func (s *State) getSchedule(wg sync.WaitGroup, r Request) {
 	defer func() { wg.Done() }()
 
-	var rd []File
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = s.Schedule
+	r.ResponseChan <- response
+
+	return
+}
+
+func (s *State) setSchedule(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
 
-	for _, file := range s.Files {
-		rd = append(rd, file)
+	var windows []UploadWindow
+	err := json.Unmarshal([]byte(r.Data), &windows)
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: "Schedule must be a JSON list of upload windows."}
+		return
 	}
 
+	err = s.SetSchedule(windows)
+	if err != nil {
+		r.ResponseChan <- Response{Type: "Error", RequestId: r.Id, Data: err.Error()}
+		return
+	}
+	s.Save()
+
+	response := Response{Type: "Response", RequestId: r.Id}
+	response.Data = s.StatusData()
+	r.ResponseChan <- response
+
+	return
+}
+
+func (s *State) getLocalFiles(wg sync.WaitGroup, r Request) {
+	defer func() { wg.Done() }()
+
+	rd := s.FindFiles(func(File) bool { return true })
+
 	response := Response{Type: "Response", RequestId: r.Id}
 	response.Data = rd
 	r.ResponseChan <- response
@@ -0,0 +1,197 @@
+package local
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/deet/picturelife-experimental-uploader/credentials"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// storedSecrets are the parts of the state kept in the credential store
+// instead of the state file.
+type storedSecrets struct {
+	Token        string
+	RefreshToken string
+}
+
+// SetCredentialStore sets where access tokens are kept. It must be called
+// before Load.
+func (state *State) SetCredentialStore(store credentials.Store) {
+	state.credentials = store
+}
+
+// credentialName is the name the secrets of account are stored under. Each
+// state file, and so each endpoint profile, keeps its own tokens.
+func (state *State) credentialName(account string) string {
+	name := filepath.Base(state.StateFile)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if account != "" {
+		name += "." + account
+	}
+	return name
+}
+
+// currentSecrets returns the secrets of every account, keyed by credential
+// name. Accounts that are logged out have empty secrets.
+func (state *State) currentSecrets() map[string]storedSecrets {
+	token := state.Api.Token()
+	secrets := map[string]storedSecrets{
+		state.credentialName(""): {
+			Token:        token.Token,
+			RefreshToken: token.RefreshToken,
+		},
+	}
+	state.accountsLock.Lock()
+	for name, acc := range state.Accounts {
+		secrets[state.credentialName(name)] = storedSecrets{
+			Token:        acc.AccessToken.Token,
+			RefreshToken: acc.AccessToken.RefreshToken,
+		}
+	}
+	state.accountsLock.Unlock()
+	return secrets
+}
+
+// saveSecrets writes the access tokens that have changed since they were last
+// stored to the credential store. Logging out, or removing an account,
+// deletes them.
+func (state *State) saveSecrets() error {
+	state.credentialsLock.Lock()
+	defer state.credentialsLock.Unlock()
+	secrets := state.currentSecrets()
+	for name := range state.storedSecrets {
+		if _, ok := secrets[name]; !ok {
+			secrets[name] = storedSecrets{}
+		}
+	}
+
+	for name, secret := range secrets {
+		if secret == state.storedSecrets[name] {
+			continue
+		}
+		if state.credentials == nil {
+			return errors.New("No credential store.")
+		}
+
+		var err error
+		if secret == (storedSecrets{}) {
+			err = state.credentials.Delete(name)
+		} else {
+			var data []byte
+			data, err = json.Marshal(secret)
+			if err == nil {
+				err = state.credentials.Set(name, data)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if secret == (storedSecrets{}) {
+			delete(state.storedSecrets, name)
+		} else {
+			state.storedSecrets[name] = secret
+		}
+	}
+	return nil
+}
+
+// loadSecrets fills in the access tokens from the credential store. Tokens
+// found in a state file written by an older version are moved into the store
+// and the state file is saved again without them.
+func (state *State) loadSecrets() {
+	for _, secret := range state.currentSecrets() {
+		if secret == (storedSecrets{}) {
+			continue
+		}
+		log.Println("Moving access tokens from", state.StateFile, "into the credential store")
+		err := state.saveSecrets()
+		state.setCredentialsError(err)
+		if err != nil {
+			// The state file is left as it is until the store works
+			return
+		}
+		state.Save()
+		return
+	}
+
+	if state.credentials == nil {
+		return
+	}
+	secret, ok := state.readSecrets("")
+	if ok {
+		token := state.Api.Token()
+		token.Token = secret.Token
+		token.RefreshToken = secret.RefreshToken
+		state.Api.SetToken(token)
+	}
+	state.accountsLock.Lock()
+	names := []string{}
+	for name := range state.Accounts {
+		names = append(names, name)
+	}
+	state.accountsLock.Unlock()
+	for _, name := range names {
+		secret, ok := state.readSecrets(name)
+		if !ok {
+			continue
+		}
+		state.accountsLock.Lock()
+		if acc, ok := state.Accounts[name]; ok {
+			acc.AccessToken.Token = secret.Token
+			acc.AccessToken.RefreshToken = secret.RefreshToken
+		}
+		state.accountsLock.Unlock()
+	}
+}
+
+// setCredentialsError records whether the secrets could be saved to the
+// credential store. While they cannot, they are only kept in memory and web
+// clients are told through a statusUpdate event.
+func (state *State) setCredentialsError(err error) {
+	message := ""
+	if err != nil {
+		message = err.Error()
+		log.Println("Could not save credentials, keeping them in memory only:", err)
+	}
+	state.credentialsLock.Lock()
+	changed := state.credentialsErr != message
+	state.credentialsErr = message
+	state.credentialsLock.Unlock()
+	if changed {
+		state.logEvent(Response{Type: "statusUpdate", RequestId: "", Data: state.StatusData()})
+	}
+}
+
+// CredentialsError returns why the secrets could not be saved to the
+// credential store, or an empty string if they were.
+func (state *State) CredentialsError() string {
+	state.credentialsLock.Lock()
+	defer state.credentialsLock.Unlock()
+	return state.credentialsErr
+}
+
+// readSecrets reads the secrets of account from the credential store and
+// remembers them as stored.
+func (state *State) readSecrets(account string) (secret storedSecrets, ok bool) {
+	name := state.credentialName(account)
+	data, err := state.credentials.Get(name)
+	if err == credentials.ErrNotFound {
+		return
+	}
+	if err != nil {
+		log.Println("Could not read credentials:", err)
+		return
+	}
+	err = json.Unmarshal(data, &secret)
+	if err != nil {
+		log.Println("Could not parse credentials:", err)
+		return
+	}
+
+	state.credentialsLock.Lock()
+	state.storedSecrets[name] = secret
+	state.credentialsLock.Unlock()
+	return secret, true
+}
@@ -0,0 +1,167 @@
+package local
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"github.com/deet/picturelife-experimental-uploader/credentials"
+)
+
+// memoryStore is a credential store that keeps secrets in memory, or fails
+// every call when broken is set.
+type memoryStore struct {
+	secrets map[string][]byte
+	broken  bool
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{secrets: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Get(name string) ([]byte, error) {
+	if s.broken {
+		return nil, errors.New("broken store")
+	}
+	secret, ok := s.secrets[name]
+	if !ok {
+		return nil, credentials.ErrNotFound
+	}
+	return secret, nil
+}
+
+func (s *memoryStore) Set(name string, secret []byte) error {
+	if s.broken {
+		return errors.New("broken store")
+	}
+	s.secrets[name] = secret
+	return nil
+}
+
+func (s *memoryStore) Delete(name string) error {
+	if s.broken {
+		return errors.New("broken store")
+	}
+	delete(s.secrets, name)
+	return nil
+}
+
+func newTestState(t *testing.T, store credentials.Store) *State {
+	t.Helper()
+	state := NewState(filepath.Join(t.TempDir(), "data.json"))
+	state.SetCredentialStore(store)
+	return &state
+}
+
+func stateFileContains(t *testing.T, state *State, text string) bool {
+	t.Helper()
+	data, err := ioutil.ReadFile(state.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Contains(data, []byte(text))
+}
+
+func TestSaveKeepsTokensInCredentialStore(t *testing.T) {
+	store := newMemoryStore()
+	state := newTestState(t, store)
+	state.Api.SetToken(api.AccessToken{Token: "access-secret", RefreshToken: "refresh-secret", Email: "someone@example.com"})
+	state.Save()
+
+	if stateFileContains(t, state, "access-secret") || stateFileContains(t, state, "refresh-secret") {
+		t.Error("state file contains the tokens")
+	}
+
+	loaded := NewState(state.StateFile)
+	loaded.SetCredentialStore(store)
+	loaded.Load()
+	token := loaded.Api.Token()
+	if token.Token != "access-secret" || token.RefreshToken != "refresh-secret" || token.Email != "someone@example.com" {
+		t.Errorf("loaded token %+v", token)
+	}
+}
+
+func TestSaveKeepsTokensInMemoryWhenStoreFails(t *testing.T) {
+	store := newMemoryStore()
+	store.broken = true
+	state := newTestState(t, store)
+	state.Api.SetToken(api.AccessToken{Token: "access-secret"})
+	state.Save()
+
+	if stateFileContains(t, state, "access-secret") {
+		t.Error("state file contains the token")
+	}
+	if state.Api.Token().Token != "access-secret" {
+		t.Error("token was lost")
+	}
+	if state.StatusData().CredentialsError == "" {
+		t.Error("failure is not reported")
+	}
+
+	// The next save stores the token once the store works again
+	store.broken = false
+	state.Save()
+	if _, err := store.Get(state.credentialName("")); err != nil {
+		t.Error(err)
+	}
+	if message := state.StatusData().CredentialsError; message != "" {
+		t.Errorf("failure is still reported: %s", message)
+	}
+}
+
+func TestLoadLeavesOldStateFileWhenStoreFails(t *testing.T) {
+	store := newMemoryStore()
+	store.broken = true
+	state := newTestState(t, store)
+	old := []byte(`{"Api":{"AccessToken":{"Token":"access-secret"}}}`)
+	if err := ioutil.WriteFile(state.StateFile, old, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	state.Load()
+	if state.Api.Token().Token != "access-secret" {
+		t.Errorf("loaded token %+v", state.Api.Token())
+	}
+	if state.CredentialsError() == "" {
+		t.Error("failure is not reported")
+	}
+	data, err := ioutil.ReadFile(state.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, old) {
+		t.Error("state file was rewritten")
+	}
+}
+
+func TestLoadMovesTokensIntoCredentialStore(t *testing.T) {
+	store := newMemoryStore()
+	state := newTestState(t, store)
+	old := []byte(`{"Api":{"AccessToken":{"Token":"access-secret","RefreshToken":"refresh-secret"}}}`)
+	if err := ioutil.WriteFile(state.StateFile, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state.Load()
+	if state.Api.Token().Token != "access-secret" {
+		t.Errorf("loaded token %+v", state.Api.Token())
+	}
+	if stateFileContains(t, state, "access-secret") {
+		t.Error("state file still contains the token")
+	}
+	if _, err := store.Get(state.credentialName("")); err != nil {
+		t.Error(err)
+	}
+
+	info, err := os.Stat(state.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("state file has mode %o, want 600", mode)
+	}
+}
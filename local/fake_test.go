@@ -0,0 +1,68 @@
+package local
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"github.com/deet/picturelife-experimental-uploader/api/apitest"
+	"github.com/deet/picturelife-experimental-uploader/util"
+)
+
+// newFakeState starts a fake server and returns a state logged in to it that
+// retries without waiting.
+func newFakeState(t *testing.T) (*apitest.Server, *State) {
+	t.Helper()
+	s := apitest.NewServer()
+	t.Cleanup(s.Close)
+
+	state := newTestState(t, newMemoryStore())
+	s.Configure(&state.Api)
+	policy := api.DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	policy.MaxBackoff = time.Millisecond
+	state.Api.SetRetryPolicy(policy)
+	state.Api.SetToken(s.IssueToken())
+	state.MaxUploadsChan = make(chan int, 100)
+	state.DirectFileChan = make(chan File, 100)
+	state.setLoggedIn(true)
+	return s, state
+}
+
+// handleFile uploads file and waits for HandleFile to return.
+func handleFile(state *State, file File) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	state.WaitForUploadSlot()
+	state.HandleFile(context.Background(), file, &wg)
+}
+
+// writeMedia writes size random bytes to a JPEG called name in dir and
+// returns its path and signature.
+func writeMedia(t *testing.T, dir, name string, size int) (path, sig string) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	path = filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, util.CalculateSignature(path)
+}
+
+// waitForCall waits until the fake server has received a request to path.
+func waitForCall(t *testing.T, s *apitest.Server, path string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for s.Calls(path) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no call to", path)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
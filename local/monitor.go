@@ -0,0 +1,229 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"log"
+	"time"
+)
+
+// errSessionExpired is the cancellation cause of uploads stopped because the
+// access token stopped working.
+var errSessionExpired = errors.New("Upload paused until the next login")
+
+// RunSessionMonitor checks the access tokens of the default account and of
+// every other account every interval until ctx is done. A token that is about
+// to expire is refreshed; a token that has been revoked or can no longer be
+// refreshed ends the session of its account through SessionExpired or
+// AccountSessionExpired.
+func (state *State) RunSessionMonitor(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if state.SessionStatus().LoggedIn {
+			state.checkSession(ctx)
+		}
+		state.checkAccountSessions(ctx)
+	}
+}
+
+func (state *State) checkSession(ctx context.Context) {
+	if !tokenWorks(ctx, &state.Api) {
+		state.SessionExpired()
+	}
+}
+
+// checkAccountSessions checks the token of every account that is logged in.
+func (state *State) checkAccountSessions(ctx context.Context) {
+	state.accountsLock.Lock()
+	names := []string{}
+	for name := range state.Accounts {
+		names = append(names, name)
+	}
+	state.accountsLock.Unlock()
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return
+		}
+		if !state.accountLoggedIn(name) {
+			continue
+		}
+		if !tokenWorks(ctx, state.apiFor(name)) {
+			state.AccountSessionExpired(name)
+		}
+	}
+}
+
+// tokenWorks refreshes the access token of accountApi if it is about to
+// expire or has been rejected. It only reports false when the token is
+// rejected and cannot be refreshed, not when the server cannot be reached.
+func tokenWorks(ctx context.Context, accountApi *api.API) bool {
+	token := accountApi.Token()
+	if token.NeedsRefresh() && token.RefreshToken != "" {
+		_, err := accountApi.RefreshAccessTokenContext(ctx)
+		if err == nil {
+			return true
+		}
+		log.Println("Could not refresh access token:", err)
+	}
+
+	valid, err := accountApi.CheckTokenContext(ctx, token.Token)
+	if err != nil {
+		// The server could not be reached; that says nothing about the token
+		log.Println("Could not check access token:", err)
+		return true
+	}
+	if valid {
+		return true
+	}
+	if token.RefreshToken != "" {
+		_, err = accountApi.RefreshAccessTokenContext(ctx)
+		if err == nil {
+			return true
+		}
+		log.Println("Could not refresh access token:", err)
+	}
+	return false
+}
+
+// SessionExpired ends the session after the access token stopped working.
+// Uploads stop and wait for the next login instead of failing, and web
+// clients get a sessionExpired event so they can ask for the password again.
+func (state *State) SessionExpired() {
+	state.sessionLock.Lock()
+	wasLoggedIn := state.loggedIn
+	state.sessionLock.Unlock()
+	if !wasLoggedIn {
+		return
+	}
+
+	log.Println("Access token is no longer valid. Uploads will resume after logging in again.")
+	state.setLoggedIn(false)
+	state.stopUploadsForLogin("")
+	state.logEvent(Response{Type: "sessionExpired", RequestId: "", Data: state.SessionStatus()})
+}
+
+// AccountSessionExpired ends the session of the account called name after its
+// access token stopped working. Its uploads stop and wait until the account
+// is logged in again with AddAccount, and web clients get an accountsUpdate
+// event.
+func (state *State) AccountSessionExpired(name string) {
+	state.accountsLock.Lock()
+	acc, ok := state.Accounts[name]
+	wasLoggedIn := ok && !acc.expired
+	if ok {
+		acc.expired = true
+	}
+	state.accountsLock.Unlock()
+	if !wasLoggedIn {
+		return
+	}
+
+	log.Println("Access token of account", name, "is no longer valid. Its uploads will resume after logging in to it again.")
+	state.stopUploadsForLogin(name)
+	state.logEvent(Response{Type: "accountsUpdate", RequestId: "", Data: state.ListAccounts()})
+}
+
+// accountLoggedIn reports whether account, or the default account for an
+// empty name, has an access token that has not stopped working.
+func (state *State) accountLoggedIn(account string) bool {
+	if account == "" {
+		return state.SessionStatus().LoggedIn
+	}
+	state.accountsLock.Lock()
+	defer state.accountsLock.Unlock()
+	acc, ok := state.Accounts[account]
+	return ok && acc.AccessToken.Token != "" && !acc.expired
+}
+
+// stopUploadsForLogin cancels every running upload of account so that it is
+// resumed after the next login.
+func (state *State) stopUploadsForLogin(account string) {
+	state.uploadsLock.Lock()
+	defer state.uploadsLock.Unlock()
+	for key, cancel := range state.uploadCancels {
+		if file, ok := state.GetFile(key); ok && file.Account != account {
+			continue
+		}
+		cancel(errSessionExpired)
+	}
+}
+
+// waitForLogin records that file could not be uploaded because the session of
+// its account ended. It is queued again by resumeAfterLogin.
+func (state *State) waitForLogin(file File) {
+	state.holdForLogin(file)
+	state.Save()
+
+	// The session may have been restored while this upload was failing
+	if state.accountLoggedIn(file.Account) {
+		state.resumeAfterLogin(file.Account)
+	}
+}
+
+// holdForLogin records file as waiting for a login without saving the state.
+func (state *State) holdForLogin(file File) {
+	log.Println("Upload waiting for login:", file.Path)
+	file.Status = "waiting-for-login"
+	file.Record("Upload waiting until logged in again")
+	state.SetFile(file)
+
+	state.sessionLock.Lock()
+	state.waitingFiles = append(state.waitingFiles, file)
+	state.sessionLock.Unlock()
+}
+
+// requeueWaitingFiles remembers the files that were waiting for a login when
+// the state was saved. Those of accounts that are logged in are queued again
+// straight away; those of the default account wait for RestoreSession.
+func (state *State) requeueWaitingFiles() {
+	waiting := state.FindFiles(func(file File) bool {
+		return file.Status == "waiting-for-login"
+	})
+	state.sessionLock.Lock()
+	state.waitingFiles = waiting
+	state.sessionLock.Unlock()
+
+	accounts := make(map[string]bool)
+	for _, file := range waiting {
+		if file.Account != "" {
+			accounts[file.Account] = true
+		}
+	}
+	for account := range accounts {
+		if state.accountLoggedIn(account) {
+			state.resumeAfterLogin(account)
+		}
+	}
+}
+
+// resumeAfterLogin queues the files of account that were waiting for a login
+// again.
+func (state *State) resumeAfterLogin(account string) {
+	state.sessionLock.Lock()
+	var resume, waiting []File
+	for _, file := range state.waitingFiles {
+		if file.Account == account {
+			resume = append(resume, file)
+		} else {
+			waiting = append(waiting, file)
+		}
+	}
+	state.waitingFiles = waiting
+	state.sessionLock.Unlock()
+	if len(resume) == 0 {
+		return
+	}
+
+	log.Println("Resuming", len(resume), "uploads that were waiting for login")
+	go func() {
+		for _, file := range resume {
+			state.DirectFileChan <- file
+		}
+	}()
+}
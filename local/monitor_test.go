@@ -0,0 +1,185 @@
+package local
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/deet/picturelife-experimental-uploader/api/apitest"
+)
+
+// receiveFile returns the next file queued on DirectFileChan.
+func receiveFile(t *testing.T, state *State) (File, bool) {
+	t.Helper()
+	select {
+	case file := <-state.DirectFileChan:
+		return file, true
+	case <-time.After(time.Second):
+		return File{}, false
+	}
+}
+
+func TestAccountUploadsWaitWhenItsTokenIsRevoked(t *testing.T) {
+	s, state := newFakeState(t)
+	if err := state.AddAccount(context.Background(), "other", s.Email, s.Password); err != nil {
+		t.Fatal(err)
+	}
+	s.RevokeTokens()
+
+	path, sig := writeMedia(t, t.TempDir(), "photo.JPG", 1000)
+	handleFile(state, File{Signature: sig, Account: "other", Path: path, Status: "pending"})
+
+	file, _ := state.GetFile(FileKey("other", sig))
+	if file.Status != "waiting-for-login" {
+		t.Fatalf("file is %s, want waiting-for-login", file.Status)
+	}
+	accounts := state.ListAccounts()
+	if len(accounts) != 2 || accounts[1].LoggedIn || !accounts[1].Expired {
+		t.Errorf("accounts are %+v", accounts)
+	}
+
+	// Logging in to the account again resumes its uploads
+	if err := state.AddAccount(context.Background(), "other", s.Email, s.Password); err != nil {
+		t.Fatal(err)
+	}
+	resumed, ok := receiveFile(t, state)
+	if !ok || resumed.Key() != FileKey("other", sig) {
+		t.Errorf("resumed %+v, %v", resumed, ok)
+	}
+}
+
+func TestLoadResumesFilesWaitingForLogin(t *testing.T) {
+	state := newTestState(t, newMemoryStore())
+	state.SetFile(File{Signature: "sig", Path: "photo.JPG", Status: "waiting-for-login"})
+	state.Save()
+
+	loaded := NewState(state.StateFile)
+	loaded.SetCredentialStore(newMemoryStore())
+	loaded.DirectFileChan = make(chan File, 1)
+	loaded.Load()
+	if status := loaded.SessionStatus(); status.Waiting != 1 {
+		t.Errorf("%d files waiting, want 1", status.Waiting)
+	}
+
+	loaded.setLoggedIn(true)
+	if file, ok := receiveFile(t, &loaded); !ok || file.Signature != "sig" {
+		t.Errorf("resumed %+v, %v", file, ok)
+	}
+}
+
+func TestAccountUploadsWhileDefaultSessionIsLoggedOut(t *testing.T) {
+	s, state := newFakeState(t)
+	if err := state.AddAccount(context.Background(), "other", s.Email, s.Password); err != nil {
+		t.Fatal(err)
+	}
+	state.Logout()
+
+	path, sig := writeMedia(t, t.TempDir(), "photo.JPG", 1000)
+	handleFile(state, File{Signature: sig, Account: "other", Path: path, Status: "pending"})
+
+	if file, _ := state.GetFile(FileKey("other", sig)); file.Status != "uploaded" {
+		t.Errorf("file of the logged in account is %s", file.Status)
+	}
+}
+
+func TestUploadDirectoryHoldsFilesOfLoggedOutAccount(t *testing.T) {
+	s, state := newFakeState(t)
+	if err := state.AddAccount(context.Background(), "other", s.Email, s.Password); err != nil {
+		t.Fatal(err)
+	}
+	otherDir := t.TempDir()
+	state.Directories[otherDir] = LocalDirectory{Path: otherDir, Account: "other"}
+	_, otherSig := writeMedia(t, otherDir, "other.JPG", 1000)
+	defaultDir := t.TempDir()
+	_, defaultSig := writeMedia(t, defaultDir, "default.JPG", 1000)
+	state.Logout()
+
+	state.UploadDirectory(defaultDir, state.DirectFileChan)
+	state.UploadDirectory(otherDir, state.DirectFileChan)
+
+	if file, _ := state.GetFile(defaultSig); file.Status != "waiting-for-login" {
+		t.Errorf("file of the logged out account is %s", file.Status)
+	}
+	if queued, ok := receiveFile(t, state); !ok || queued.Key() != FileKey("other", otherSig) {
+		t.Errorf("queued %+v, %v", queued, ok)
+	}
+
+	// Logging in again queues the held file
+	if err := state.Login(context.Background(), s.Email, s.Password); err != nil {
+		t.Fatal(err)
+	}
+	if resumed, ok := receiveFile(t, state); !ok || resumed.Signature != defaultSig {
+		t.Errorf("resumed %+v, %v", resumed, ok)
+	}
+}
+
+// runSessionMonitor runs the session monitor of state every millisecond until
+// the test ends.
+func runSessionMonitor(t *testing.T, state *State) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go state.RunSessionMonitor(ctx, time.Millisecond)
+}
+
+func TestSessionMonitorEndsRevokedSession(t *testing.T) {
+	s, state := newFakeState(t)
+	events := make(chan Response, 10)
+	state.RegisterObserver(events)
+	s.RevokeTokens()
+
+	runSessionMonitor(t, state)
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type != "sessionExpired" {
+				continue
+			}
+			if state.SessionStatus().LoggedIn {
+				t.Error("still logged in after the session expired")
+			}
+			return
+		case <-timeout:
+			t.Fatal("no sessionExpired event after the token was revoked")
+		}
+	}
+}
+
+func TestSessionMonitorRefreshesExpiredToken(t *testing.T) {
+	s, state := newFakeState(t)
+	old := state.Api.Token().Token
+	s.ExpireToken(old)
+
+	state.checkSession(context.Background())
+
+	if !state.SessionStatus().LoggedIn {
+		t.Fatal("session ended although the token could be refreshed")
+	}
+	if state.Api.Token().Token == old {
+		t.Error("expired token was not refreshed")
+	}
+}
+
+func TestSessionMonitorKeepsSessionWhenServerIsUnreachable(t *testing.T) {
+	s, state := newFakeState(t)
+	s.Fail(apitest.Failure{Path: "oauth/check_token", HTTPStatus: 503})
+
+	state.checkSession(context.Background())
+
+	if !state.SessionStatus().LoggedIn {
+		t.Error("session ended because the server could not be reached")
+	}
+}
+
+func TestSessionMonitorSkipsLoggedOutSession(t *testing.T) {
+	s, state := newFakeState(t)
+	state.Logout()
+
+	runSessionMonitor(t, state)
+	time.Sleep(50 * time.Millisecond)
+
+	if calls := s.Calls("oauth/check_token"); calls != 0 {
+		t.Errorf("checked the token of a logged out session %d times", calls)
+	}
+}
@@ -0,0 +1,99 @@
+package local
+
+import (
+	"context"
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"log"
+	"time"
+)
+
+// RunProcessingPoller checks files that have been uploaded but are still
+// being processed by Picturelife every interval, until ctx is done. Files
+// whose album could not be set are retried at the same time. Files of
+// accounts that are not logged in are left until the next login.
+func (state *State) RunProcessingPoller(ctx context.Context, interval time.Duration) {
+	for {
+		state.pollPendingMedia(ctx)
+		state.assignPendingAlbums(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// pollPendingMedia fills in the media ID of every pending file whose
+// processing has completed, and marks files whose processing failed as
+// processing-failed. A pending media the server does not know is never
+// going to complete, so its file is marked as processing-failed too.
+func (state *State) pollPendingMedia(ctx context.Context) {
+	pending := state.FindFiles(func(file File) bool {
+		return file.Status == "uploaded" && file.PendingMediaId != "" && file.MediaId == ""
+	})
+	if len(pending) == 0 {
+		return
+	}
+	log.Println("Checking processing status of", len(pending), "uploaded files")
+
+	changed := false
+	for _, file := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		if !state.accountLoggedIn(file.Account) {
+			continue
+		}
+		pendingMedia, media, err := state.apiFor(file.Account).GetPendingMediaContext(ctx, file.PendingMediaId)
+		if err != nil && !api.IsNotFound(err) {
+			log.Println("Could not check pending media", file.PendingMediaId, err)
+			continue
+		}
+		// Only the fields the poller owns are applied, to the file as it is
+		// by then
+		var apply func(current *File)
+		if err != nil || pendingMedia.Id == "" {
+			log.Printf("File (%s) has no pending media on the server. Pending media ID: %s\n", file.Path, file.PendingMediaId)
+			apply = func(current *File) {
+				current.Status = "processing-failed"
+				current.Record("Pending media " + file.PendingMediaId + " no longer exists")
+			}
+		} else if pendingMedia.Error {
+			log.Printf("File (%s) failed processing. Pending media ID: %s Error: %v\n", file.Path, file.PendingMediaId, pendingMedia.ErrorData)
+			apply = func(current *File) {
+				current.Status = "processing-failed"
+				current.ProcessingErrorData = pendingMedia.ErrorData
+			}
+		} else if pendingMedia.ProcessingComplete && pendingMedia.MediaId != "" {
+			log.Printf("File (%s) processed. Media ID: %s\n", file.Path, pendingMedia.MediaId)
+			file.MediaId = pendingMedia.MediaId
+			state.cacheRemoteMedia(file.Account, media)
+			file = state.assignAlbum(ctx, file)
+			apply = func(current *File) {
+				current.MediaId = file.MediaId
+				if current.Album == file.Album {
+					current.AlbumAdded = file.AlbumAdded
+				}
+			}
+		} else {
+			continue
+		}
+		pendingMediaId := file.PendingMediaId
+		updated := state.updateFile(file.Key(), func(current *File) bool {
+			// Leave files that were uploaded again, cancelled or removed
+			// while the server was being asked
+			if current.Status != "uploaded" || current.PendingMediaId != pendingMediaId || current.MediaId != "" {
+				return false
+			}
+			apply(current)
+			return true
+		})
+		if updated {
+			changed = true
+		}
+	}
+
+	if changed {
+		state.Save()
+	}
+}
@@ -0,0 +1,103 @@
+package local
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/deet/picturelife-experimental-uploader/api/apitest"
+)
+
+func TestPollerRecordsProcessedMedia(t *testing.T) {
+	s, state := newFakeState(t)
+	s.ProcessingDelay = 0
+	path, sig := writeMedia(t, t.TempDir(), "photo.JPG", 1000)
+	handleFile(state, File{Signature: sig, Path: path, Status: "pending"})
+
+	state.pollPendingMedia(context.Background())
+
+	file, _ := state.GetFile(sig)
+	if file.Status != "uploaded" || file.MediaId == "" {
+		t.Errorf("file is %+v after processing", file)
+	}
+}
+
+func TestPollerKeepsPendingMediaOnServerErrors(t *testing.T) {
+	s, state := newFakeState(t)
+	state.SetFile(File{Signature: "sig", Path: "photo.JPG", Status: "uploaded", PendingMediaId: "pending1"})
+	s.Fail(apitest.Failure{Path: "pending_medias/show"})
+
+	state.pollPendingMedia(context.Background())
+
+	file, _ := state.GetFile("sig")
+	if file.Status != "uploaded" {
+		t.Errorf("file is %s after a server error", file.Status)
+	}
+}
+
+func TestPollerFailsMissingPendingMedia(t *testing.T) {
+	_, state := newFakeState(t)
+	state.SetFile(File{Signature: "sig", Path: "photo.JPG", Status: "uploaded", PendingMediaId: "unknown"})
+
+	state.pollPendingMedia(context.Background())
+
+	file, _ := state.GetFile("sig")
+	if file.Status != "processing-failed" {
+		t.Errorf("file is %s, want processing-failed", file.Status)
+	}
+	// A failed file is not polled again
+	if pending := state.FindFiles(func(f File) bool { return f.Status == "uploaded" }); len(pending) != 0 {
+		t.Errorf("%d files still pending", len(pending))
+	}
+}
+
+func TestPollerKeepsChangesMadeWhileAsking(t *testing.T) {
+	s, state := newFakeState(t)
+	s.ProcessingDelay = 0
+	path, sig := writeMedia(t, t.TempDir(), "photo.JPG", 1000)
+	handleFile(state, File{Signature: sig, Path: path, Status: "pending"})
+	s.Fail(apitest.Failure{Path: "pending_medias/show", Times: 1, Delay: 100 * time.Millisecond})
+
+	done := make(chan struct{})
+	go func() {
+		state.pollPendingMedia(context.Background())
+		close(done)
+	}()
+	waitForCall(t, s, "pending_medias/show")
+	state.updateFile(sig, func(file *File) bool {
+		file.Record("Changed while the poller was asking")
+		return true
+	})
+	<-done
+
+	file, _ := state.GetFile(sig)
+	if file.MediaId == "" {
+		t.Error("media ID was not recorded")
+	}
+	if last := file.History[len(file.History)-1]; last.Message != "Changed while the poller was asking" {
+		t.Errorf("last history entry is %q", last.Message)
+	}
+}
+
+func TestPollerSkipsFileUploadedAgain(t *testing.T) {
+	s, state := newFakeState(t)
+	state.SetFile(File{Signature: "sig", Path: "photo.JPG", Status: "uploaded", PendingMediaId: "unknown"})
+	s.Fail(apitest.Failure{Path: "pending_medias/show", Times: 1, Delay: 100 * time.Millisecond})
+
+	done := make(chan struct{})
+	go func() {
+		state.pollPendingMedia(context.Background())
+		close(done)
+	}()
+	waitForCall(t, s, "pending_medias/show")
+	state.updateFile("sig", func(file *File) bool {
+		file.Status = "retrying"
+		file.PendingMediaId = ""
+		return true
+	})
+	<-done
+
+	if file, _ := state.GetFile("sig"); file.Status != "retrying" {
+		t.Errorf("file uploaded again is %s", file.Status)
+	}
+}
@@ -0,0 +1,114 @@
+package local
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RunReconciler reconciles the local upload state against the server every
+// interval until ctx is done.
+func (state *State) RunReconciler(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		state.Reconcile(ctx)
+	}
+}
+
+// Reconcile re-checks the signatures of every uploaded file with the server
+// and updates each file to uploaded, uploaded-deleted or missing-remote. Files
+// still being processed, and files of accounts that are not logged in, are
+// left alone. Every changed file emits a fileUpdate event.
+func (state *State) Reconcile(ctx context.Context) (checked, changed int, err error) {
+	files := state.FindFiles(func(file File) bool {
+		switch file.Status {
+		case "uploaded", "uploaded-deleted", "missing-remote":
+			return file.MediaId != ""
+		}
+		return false
+	})
+	log.Println("Reconciling", len(files), "uploaded files with the server")
+
+	byAccount := make(map[string][]File)
+	for _, file := range files {
+		byAccount[file.Account] = append(byAccount[file.Account], file)
+	}
+	for account, accountFiles := range byAccount {
+		if !state.accountLoggedIn(account) {
+			log.Println("Not reconciling", len(accountFiles), "files until their account is logged in")
+			continue
+		}
+		accountChecked, accountChanged, accountErr := state.reconcileAccount(ctx, account, accountFiles)
+		checked += accountChecked
+		changed += accountChanged
+		if accountErr != nil {
+			err = accountErr
+		}
+	}
+
+	log.Println("Reconciled", checked, "files,", changed, "changed")
+	if changed > 0 {
+		state.Save()
+	}
+	return
+}
+
+// reconcileAccount re-checks files uploaded to account in batches.
+func (state *State) reconcileAccount(ctx context.Context, account string, files []File) (checked, changed int, err error) {
+	accountApi := state.apiFor(account)
+	batchSize := accountApi.SignatureBatchSize()
+	for start := 0; start < len(files); start += batchSize {
+		end := start + batchSize
+		if end > len(files) {
+			end = len(files)
+		}
+		batch := files[start:end]
+
+		sigs := []string{}
+		for _, file := range batch {
+			sigs = append(sigs, file.Signature)
+		}
+		remote, checkErr := accountApi.CheckSignaturesContext(ctx, sigs)
+		if checkErr != nil {
+			log.Println("Could not reconcile uploaded files:", checkErr)
+			err = checkErr
+			break
+		}
+
+		for _, file := range batch {
+			checked++
+			status := "missing-remote"
+			mediaId := file.MediaId
+			if sigResponse, found := remote[file.Signature]; found && sigResponse.MediaId != "" {
+				mediaId = sigResponse.MediaId
+				status = "uploaded"
+				if sigResponse.Deleted {
+					status = "uploaded-deleted"
+				}
+			}
+			if status == file.Status && mediaId == file.MediaId {
+				continue
+			}
+			updated := state.updateFile(file.Key(), func(current *File) bool {
+				// Leave files that were uploaded again or removed while the
+				// server was being asked
+				if current.Status != file.Status || current.MediaId != file.MediaId {
+					return false
+				}
+				current.Status = status
+				current.MediaId = mediaId
+				return true
+			})
+			if !updated {
+				continue
+			}
+			log.Printf("File (%s) changed from %s to %s. Media ID: %s\n", file.Path, file.Status, status, mediaId)
+			changed++
+		}
+	}
+	return
+}
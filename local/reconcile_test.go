@@ -0,0 +1,38 @@
+package local
+
+import (
+	"context"
+	"testing"
+)
+
+func TestReconcileMarksMissingMedia(t *testing.T) {
+	_, state := newFakeState(t)
+	state.SetFile(File{Signature: "sig", Path: "photo.JPG", Status: "uploaded", MediaId: "media1"})
+
+	checked, changed, err := state.Reconcile(context.Background())
+	if err != nil || checked != 1 || changed != 1 {
+		t.Fatalf("Reconcile returned %d checked, %d changed, %v", checked, changed, err)
+	}
+	if file, _ := state.GetFile("sig"); file.Status != "missing-remote" {
+		t.Errorf("file is %s, want missing-remote", file.Status)
+	}
+}
+
+func TestReconcileKeepsChangesMadeWhileChecking(t *testing.T) {
+	_, state := newFakeState(t)
+	state.SetFile(File{Signature: "sig", Path: "photo.JPG", Status: "uploaded", MediaId: "media1"})
+	snapshot := state.FindFiles(func(File) bool { return true })
+
+	// The file is uploaded again while the server is being asked about it
+	retrying, _ := state.GetFile("sig")
+	retrying.Status = "retrying"
+	state.SetFile(retrying)
+
+	_, changed, err := state.reconcileAccount(context.Background(), "", snapshot)
+	if err != nil || changed != 0 {
+		t.Fatalf("reconcileAccount changed %d files, %v", changed, err)
+	}
+	if file, _ := state.GetFile("sig"); file.Status != "retrying" {
+		t.Errorf("file is %s, want retrying", file.Status)
+	}
+}
@@ -0,0 +1,84 @@
+package local
+
+import (
+	"context"
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"log"
+)
+
+// SyncRemoteMedia fetches every media in account, or the default account for
+// an empty name, and replaces the cached remote records of that account with
+// them. The records of other accounts are kept.
+func (state *State) SyncRemoteMedia(ctx context.Context, account string) (count int, err error) {
+	medias, err := state.apiFor(account).ListAllMediaContext(ctx)
+	if err != nil {
+		log.Println("Could not list remote media:", err)
+		return
+	}
+
+	remote := make(map[string]api.Media, len(medias))
+	for _, media := range medias {
+		remote[media.Id] = media
+	}
+	state.filesLock.Lock()
+	state.remoteMedia[account] = remote
+	state.filesLock.Unlock()
+
+	count = len(medias)
+	log.Println("Cached", count, "remote media")
+	return
+}
+
+// FetchRemoteMedia fetches the media with the given ID from account and
+// caches it.
+func (state *State) FetchRemoteMedia(ctx context.Context, account, mediaId string) (media api.Media, err error) {
+	media, err = state.apiFor(account).GetMediaContext(ctx, mediaId)
+	if err != nil {
+		log.Println("Could not fetch media", mediaId, err)
+		return
+	}
+	state.cacheRemoteMedia(account, media)
+	return
+}
+
+func (state *State) cacheRemoteMedia(account string, media api.Media) {
+	if media.Id == "" {
+		return
+	}
+	state.filesLock.Lock()
+	defer state.filesLock.Unlock()
+	if state.remoteMedia[account] == nil {
+		state.remoteMedia[account] = make(map[string]api.Media)
+	}
+	state.remoteMedia[account][media.Id] = media
+}
+
+// GetRemoteMedia returns the cached remote record for mediaId in account.
+func (state *State) GetRemoteMedia(account, mediaId string) (media api.Media, ok bool) {
+	state.filesLock.RLock()
+	defer state.filesLock.RUnlock()
+	media, ok = state.remoteMedia[account][mediaId]
+	return
+}
+
+// RemoteMediaList returns every cached remote record of account.
+func (state *State) RemoteMediaList(account string) []api.Media {
+	state.filesLock.RLock()
+	defer state.filesLock.RUnlock()
+	medias := make([]api.Media, 0, len(state.remoteMedia[account]))
+	for _, media := range state.remoteMedia[account] {
+		medias = append(medias, media)
+	}
+	return medias
+}
+
+// RemoteMediaForFile returns the cached remote record of the local file with
+// the given key.
+func (state *State) RemoteMediaForFile(key string) (media api.Media, ok bool) {
+	file, ok := state.GetFile(key)
+	if !ok || file.MediaId == "" {
+		ok = false
+		return
+	}
+	return state.GetRemoteMedia(file.Account, file.MediaId)
+}
@@ -0,0 +1,44 @@
+package local
+
+import (
+	"context"
+	"testing"
+
+	"github.com/deet/picturelife-experimental-uploader/api"
+)
+
+func TestSyncRemoteMediaKeepsOtherAccounts(t *testing.T) {
+	s, state := newFakeState(t)
+	if err := state.AddAccount(context.Background(), "other", s.Email, s.Password); err != nil {
+		t.Fatal(err)
+	}
+	state.cacheRemoteMedia("", api.Media{Id: "cached-default"})
+	mediaId := s.AddMedia("sig", false)
+
+	count, err := state.SyncRemoteMedia(context.Background(), "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("synced %d media, want 1", count)
+	}
+	if _, ok := state.GetRemoteMedia("other", mediaId); !ok {
+		t.Error("synced media is not cached for its account")
+	}
+	if _, ok := state.GetRemoteMedia("", "cached-default"); !ok {
+		t.Error("media cached for the default account was dropped")
+	}
+	if _, ok := state.GetRemoteMedia("", mediaId); ok {
+		t.Error("media synced for another account is cached for the default account")
+	}
+}
+
+func TestSaveLeavesOutRemoteMedia(t *testing.T) {
+	_, state := newFakeState(t)
+	state.cacheRemoteMedia("", api.Media{Id: "cached-media"})
+	state.Save()
+
+	if stateFileContains(t, state, "cached-media") {
+		t.Error("state file contains the remote media cache")
+	}
+}
@@ -0,0 +1,139 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"github.com/deet/picturelife-experimental-uploader/api"
+	"github.com/deet/picturelife-experimental-uploader/util"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type RestoreData struct {
+	Restored int
+	Skipped  int
+	Failed   int
+}
+
+// Restore downloads the original of every media in the default account into
+// dir, skipping media that are already in the local library. Each download is
+// checked against the media's signature and recorded as uploaded so that it
+// is not uploaded again. Interrupted downloads are left as .part files and
+// resume on the next restore.
+func (state *State) Restore(ctx context.Context, dir string) (result RestoreData, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+
+	_, err = state.SyncRemoteMedia(ctx, "")
+	if err != nil {
+		return
+	}
+
+	medias := state.RemoteMediaList("")
+
+	log.Println("Restoring", len(medias), "media into", dir)
+	for _, media := range medias {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+		if media.Deleted || media.Url == "" || state.haveLocalCopy(media) {
+			result.Skipped++
+			continue
+		}
+		restoreErr := state.restoreMedia(ctx, media, dir)
+		if restoreErr != nil {
+			log.Println("Could not restore media", media.Id, restoreErr)
+			result.Failed++
+			continue
+		}
+		result.Restored++
+	}
+
+	log.Printf("Restore finished: %d restored, %d skipped, %d failed\n", result.Restored, result.Skipped, result.Failed)
+	state.Save()
+	return
+}
+
+// haveLocalCopy reports whether the library already has a file on disk with
+// the signature of media.
+func (state *State) haveLocalCopy(media api.Media) bool {
+	if media.Signature == "" {
+		return false
+	}
+	file, ok := state.GetFile(media.Signature)
+	if !ok || file.MissingOnFilesystem {
+		return false
+	}
+	_, err := os.Stat(file.Path)
+	return err == nil
+}
+
+// restoreMedia downloads the original of media into dir and records it. A
+// media without a signature is fetched again to get one, since the download
+// could not be checked otherwise.
+func (state *State) restoreMedia(ctx context.Context, media api.Media, dir string) error {
+	if media.Signature == "" {
+		fetched, err := state.Api.GetMediaContext(ctx, media.Id)
+		if err != nil {
+			return err
+		}
+		if fetched.Signature == "" {
+			return fmt.Errorf("Media %s has no signature, so the download could not be verified.", media.Id)
+		}
+		media.Signature = fetched.Signature
+	}
+
+	name := media.Id
+	if media.Format != "" {
+		name = fmt.Sprintf("%s.%s", media.Id, strings.ToLower(media.Format))
+	}
+	path := filepath.Join(dir, name)
+	partPath := path + ".part"
+
+	// A file already at path may be left from an earlier restore that
+	// stopped before recording it. It is only used if it is the media, and
+	// is never replaced or removed since it may be the user's own file.
+	if _, err := os.Stat(path); err == nil {
+		signature := util.CalculateSignature(path)
+		if signature != media.Signature {
+			return fmt.Errorf("%s already exists and is not media %s, leaving it in place.", path, media.Id)
+		}
+		state.recordRestored(media, path, name, signature)
+		return nil
+	}
+
+	err := state.Api.DownloadOriginal(ctx, media, partPath)
+	if err != nil {
+		return err
+	}
+	signature := util.CalculateSignature(partPath)
+	if signature != media.Signature {
+		os.Remove(partPath)
+		return fmt.Errorf("Signature of %s does not match the server: got %s, expected %s", partPath, signature, media.Signature)
+	}
+	err = os.Rename(partPath, path)
+	if err != nil {
+		return err
+	}
+	state.recordRestored(media, path, name, signature)
+	return nil
+}
+
+// recordRestored records the original of media restored at path as uploaded
+// so that it is not uploaded again.
+func (state *State) recordRestored(media api.Media, path, name, signature string) {
+	state.SetFile(File{
+		Signature: signature,
+		Path:      path,
+		MediaId:   media.Id,
+		Status:    "uploaded",
+		Name:      name,
+		Extension: strings.ToUpper(filepath.Ext(name)),
+	})
+	log.Printf("File (%s) restored. Media ID: %s\n", path, media.Id)
+}
@@ -0,0 +1,42 @@
+package local
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreLeavesConflictingFileInPlace(t *testing.T) {
+	_, state := newFakeState(t)
+	path, sig := writeMedia(t, t.TempDir(), "photo.JPG", 1000)
+	handleFile(state, File{Signature: sig, Path: path, Status: "pending"})
+	state.DelFile(sig)
+
+	dir := t.TempDir()
+	result, err := state.Restore(context.Background(), dir)
+	if err != nil || result.Restored != 1 {
+		t.Fatalf("restore returned %+v, %v", result, err)
+	}
+	restored, ok := state.GetFile(sig)
+	if !ok || restored.Status != "uploaded" {
+		t.Fatalf("restored file is %+v", restored)
+	}
+
+	// Another file where the media would be restored is not the media and
+	// must not be touched
+	state.DelFile(sig)
+	conflictDir := t.TempDir()
+	conflict := filepath.Join(conflictDir, filepath.Base(restored.Path))
+	if err := os.WriteFile(conflict, []byte("someone else's file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err = state.Restore(context.Background(), conflictDir)
+	if err != nil || result.Failed != 1 {
+		t.Fatalf("restore returned %+v, %v", result, err)
+	}
+	data, err := os.ReadFile(conflict)
+	if err != nil || string(data) != "someone else's file" {
+		t.Errorf("conflicting file now holds %q, %v", data, err)
+	}
+}
@@ -0,0 +1,372 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadWindow is a weekly period during which uploads may run.
+type UploadWindow struct {
+	// Days the window starts on ("Mon", "Tue", ...). Empty means every day.
+	Days []string
+	// Start and End are local times of day ("22:00"). A window whose End is
+	// not after its Start runs past midnight into the next day.
+	Start string
+	End   string
+	// Concurrency is the number of uploads allowed at once. Zero keeps
+	// uploads paused for the whole window. It cannot exceed -concurrent.
+	Concurrency int
+	// BandwidthLimit is the bandwidth cap in bytes per second while the
+	// window is active. Zero leaves the global limit in place.
+	BandwidthLimit int64
+}
+
+// ScheduleStatus describes what the upload schedule allows right now.
+type ScheduleStatus struct {
+	Scheduled      bool          // false if no windows are configured and uploads always run
+	Open           bool          // whether uploads may run now
+	ActiveWindow   *UploadWindow // window in effect, nil outside all windows
+	NextChange     time.Time     // when the schedule next opens, closes or switches windows
+	Concurrency    int           // uploads allowed at once, -1 for no schedule limit
+	BandwidthLimit int64         // bandwidth limit in effect
+	Paused         int           // files waiting for a window to open
+}
+
+// errUploadPaused is the cancellation cause of uploads stopped because their
+// window closed.
+var errUploadPaused = errors.New("Upload paused until the next upload window")
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseTimeOfDay reads a time of day from "00:00" to "24:00", where 24:00 is
+// the end of the day.
+func parseTimeOfDay(value string) (hours, minutes int, err error) {
+	_, err = fmt.Sscanf(value, "%d:%d", &hours, &minutes)
+	if err != nil || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, 0, errors.New(fmt.Sprintln("Invalid time of day:", value))
+	}
+	return
+}
+
+func (w UploadWindow) validate() error {
+	for _, day := range w.Days {
+		if len(day) < 3 {
+			return errors.New(fmt.Sprintln("Invalid day:", day))
+		}
+		if _, ok := weekdays[strings.ToLower(day)[:3]]; !ok {
+			return errors.New(fmt.Sprintln("Invalid day:", day))
+		}
+	}
+	if _, _, err := parseTimeOfDay(w.Start); err != nil {
+		return err
+	}
+	if _, _, err := parseTimeOfDay(w.End); err != nil {
+		return err
+	}
+	if w.Concurrency < 0 || w.BandwidthLimit < 0 {
+		return errors.New("Concurrency and bandwidth limit cannot be negative.")
+	}
+	return nil
+}
+
+func (w UploadWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if len(d) >= 3 && weekdays[strings.ToLower(d)[:3]] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// span returns when the window starting on the day of midnight begins and
+// ends. The times are built from the date rather than added to midnight, so
+// that they are right on days when the clocks change.
+func (w UploadWindow) span(midnight time.Time) (start, end time.Time) {
+	startHours, startMinutes, _ := parseTimeOfDay(w.Start)
+	endHours, endMinutes, _ := parseTimeOfDay(w.End)
+	year, month, day := midnight.Date()
+	start = time.Date(year, month, day, startHours, startMinutes, 0, 0, midnight.Location())
+	end = time.Date(year, month, day, endHours, endMinutes, 0, 0, midnight.Location())
+	if !end.After(start) {
+		end = time.Date(year, month, day+1, endHours, endMinutes, 0, 0, midnight.Location())
+	}
+	return
+}
+
+func midnightOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// activeWindow returns the index of the first window containing t, or -1.
+func activeWindow(windows []UploadWindow, t time.Time) int {
+	today := midnightOf(t)
+	for i, w := range windows {
+		// A window that started yesterday may still be running
+		for _, midnight := range []time.Time{today.AddDate(0, 0, -1), today} {
+			if !w.onDay(midnight.Weekday()) {
+				continue
+			}
+			start, end := w.span(midnight)
+			if !t.Before(start) && t.Before(end) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// nextChange returns the first time after now at which a different window
+// (or none) becomes active. It is zero if the schedule never changes.
+func nextChange(windows []UploadWindow, now time.Time) time.Time {
+	current := activeWindow(windows, now)
+	boundaries := []time.Time{}
+	today := midnightOf(now)
+	for day := -1; day <= 8; day++ {
+		midnight := today.AddDate(0, 0, day)
+		for _, w := range windows {
+			if !w.onDay(midnight.Weekday()) {
+				continue
+			}
+			start, end := w.span(midnight)
+			boundaries = append(boundaries, start, end)
+		}
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i].Before(boundaries[j]) })
+	for _, b := range boundaries {
+		if b.After(now) && activeWindow(windows, b) != current {
+			return b
+		}
+	}
+	return time.Time{}
+}
+
+// uploadSlots is a counting semaphore whose size the schedule changes.
+type uploadSlots struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int // -1 for no limit
+	active int
+}
+
+func newUploadSlots() *uploadSlots {
+	s := &uploadSlots{limit: -1}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *uploadSlots) acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.limit >= 0 && s.active >= s.limit {
+		s.cond.Wait()
+	}
+	s.active++
+}
+
+func (s *uploadSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	s.cond.Broadcast()
+}
+
+func (s *uploadSlots) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.cond.Broadcast()
+}
+
+// WaitForUploadSlot blocks until the upload schedule allows another upload to
+// start. Every call must be matched by a call to ReleaseUploadSlot, which
+// HandleFile makes when it finishes.
+func (state *State) WaitForUploadSlot() {
+	state.slots.acquire()
+}
+
+func (state *State) ReleaseUploadSlot() {
+	state.slots.release()
+}
+
+// SetSchedule replaces the upload windows. An empty schedule lets uploads run
+// at any time.
+func (state *State) SetSchedule(windows []UploadWindow) error {
+	for _, w := range windows {
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+	state.scheduleLock.Lock()
+	state.Schedule = windows
+	state.scheduleLock.Unlock()
+	state.applySchedule()
+	return nil
+}
+
+// LoadScheduleFile reads a JSON array of UploadWindow values from path.
+func (state *State) LoadScheduleFile(path string) error {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var windows []UploadWindow
+	err = json.Unmarshal(file, &windows)
+	if err != nil {
+		return errors.New(fmt.Sprintln("Could not parse schedule file:", err))
+	}
+	return state.SetSchedule(windows)
+}
+
+func (state *State) ScheduleStatus() ScheduleStatus {
+	state.scheduleLock.Lock()
+	defer state.scheduleLock.Unlock()
+	return state.scheduleStatus
+}
+
+// RunSchedule applies the upload schedule until ctx is done, switching
+// windows as they open and close.
+func (state *State) RunSchedule(ctx context.Context) {
+	for {
+		status := state.applySchedule()
+
+		wait := time.Minute
+		if !status.NextChange.IsZero() {
+			wait = time.Until(status.NextChange)
+		}
+		// Wake up at least once a minute so clock changes are noticed
+		if wait > time.Minute {
+			wait = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// applySchedule works out the window in effect now and, if it changed, sets
+// the upload concurrency and bandwidth to match. Uploads running when the
+// schedule closes are paused, and paused files are queued again when it
+// opens.
+func (state *State) applySchedule() ScheduleStatus {
+	now := time.Now()
+
+	state.scheduleLock.Lock()
+	windows := state.Schedule
+	status := ScheduleStatus{
+		Scheduled:      len(windows) > 0,
+		Open:           true,
+		Concurrency:    -1,
+		BandwidthLimit: state.BandwidthLimit,
+	}
+	if status.Scheduled {
+		status.Open = false
+		status.Concurrency = 0
+		if i := activeWindow(windows, now); i >= 0 {
+			window := windows[i]
+			status.ActiveWindow = &window
+			status.Concurrency = window.Concurrency
+			status.Open = window.Concurrency > 0
+			if window.BandwidthLimit > 0 {
+				status.BandwidthLimit = window.BandwidthLimit
+			}
+		}
+		status.NextChange = nextChange(windows, now)
+	}
+	status.Paused = len(state.pausedFiles)
+	previous := state.scheduleStatus
+	state.scheduleStatus = status
+	var resume []File
+	if status.Open {
+		resume = state.pausedFiles
+		state.pausedFiles = nil
+		status.Paused = 0
+		state.scheduleStatus.Paused = 0
+	}
+	state.scheduleLock.Unlock()
+
+	state.slots.setLimit(status.Concurrency)
+	state.bandwidth.SetRate(status.BandwidthLimit)
+
+	changed := previous.Open != status.Open || previous.Concurrency != status.Concurrency ||
+		previous.BandwidthLimit != status.BandwidthLimit || !previous.NextChange.Equal(status.NextChange)
+	if !changed && len(resume) == 0 {
+		return status
+	}
+
+	if status.Scheduled {
+		if status.Open {
+			log.Println("Upload window open. Concurrency:", status.Concurrency, "Bandwidth limit:", status.BandwidthLimit, "Next change:", status.NextChange)
+		} else {
+			log.Println("Outside upload window. Next change:", status.NextChange)
+		}
+	}
+
+	if !status.Open && previous.Open {
+		state.pauseUploads()
+	}
+	if len(resume) > 0 {
+		log.Println("Resuming", len(resume), "paused uploads")
+		go func() {
+			for _, file := range resume {
+				state.DirectFileChan <- file
+			}
+		}()
+	}
+
+	state.logEvent(Response{Type: "statusUpdate", RequestId: "", Data: state.StatusData()})
+	return status
+}
+
+// uploadsAllowed reports whether the schedule currently lets uploads run.
+func (state *State) uploadsAllowed() bool {
+	state.scheduleLock.Lock()
+	defer state.scheduleLock.Unlock()
+	return state.scheduleStatus.Open || !state.scheduleStatus.Scheduled
+}
+
+// pauseUploads stops every running upload so it can be resumed in the next
+// window.
+func (state *State) pauseUploads() {
+	state.uploadsLock.Lock()
+	defer state.uploadsLock.Unlock()
+	for _, cancel := range state.uploadCancels {
+		cancel(errUploadPaused)
+	}
+}
+
+// requeuePausedFiles remembers the files whose uploads were paused by the
+// schedule before the state was saved, so that they resume in the next
+// window.
+func (state *State) requeuePausedFiles() {
+	paused := state.FindFiles(func(file File) bool {
+		return file.Status == "paused"
+	})
+	state.scheduleLock.Lock()
+	state.pausedFiles = paused
+	state.scheduleStatus.Paused = len(paused)
+	state.scheduleLock.Unlock()
+}
+
+// addPausedFile remembers a file whose upload was paused by the schedule.
+func (state *State) addPausedFile(file File) {
+	state.scheduleLock.Lock()
+	state.pausedFiles = append(state.pausedFiles, file)
+	state.scheduleStatus.Paused = len(state.pausedFiles)
+	state.scheduleLock.Unlock()
+}
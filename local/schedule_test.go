@@ -0,0 +1,173 @@
+package local
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeOfDay(t *testing.T) {
+	for _, value := range []string{"00:00", "9:30", "23:59", "24:00"} {
+		if _, _, err := parseTimeOfDay(value); err != nil {
+			t.Errorf("parseTimeOfDay(%q) failed: %v", value, err)
+		}
+	}
+	for _, value := range []string{"", "noon", "24:01", "24:59", "25:00", "12:60", "-1:00"} {
+		if _, _, err := parseTimeOfDay(value); err == nil {
+			t.Errorf("parseTimeOfDay(%q) succeeded", value)
+		}
+	}
+}
+
+func TestWindowSpanOnDSTDay(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone database not available:", err)
+	}
+	// Clocks go forward from 02:00 to 03:00 on 8 March 2026
+	midnight := time.Date(2026, time.March, 8, 0, 0, 0, 0, location)
+	start, end := UploadWindow{Start: "01:00", End: "04:00"}.span(midnight)
+	if start.Hour() != 1 || end.Hour() != 4 {
+		t.Errorf("window runs from %s to %s, want 01:00 to 04:00", start, end)
+	}
+
+	// Overnight windows end on the next day
+	start, end = UploadWindow{Start: "22:00", End: "06:00"}.span(midnight)
+	if start.Day() != 8 || start.Hour() != 22 || end.Day() != 9 || end.Hour() != 6 {
+		t.Errorf("window runs from %s to %s", start, end)
+	}
+}
+
+func TestLoadResumesPausedFiles(t *testing.T) {
+	state := newTestState(t, newMemoryStore())
+	state.SetFile(File{Signature: "sig", Path: "photo.JPG", Status: "paused"})
+	state.Save()
+
+	loaded := NewState(state.StateFile)
+	loaded.SetCredentialStore(newMemoryStore())
+	loaded.DirectFileChan = make(chan File, 1)
+	loaded.Load()
+
+	select {
+	case file := <-loaded.DirectFileChan:
+		if file.Signature != "sig" {
+			t.Errorf("resumed %+v", file)
+		}
+	case <-time.After(time.Second):
+		t.Error("paused file was not resumed")
+	}
+}
+
+func TestSetBandwidthLimitChangesUploadRate(t *testing.T) {
+	state := newTestState(t, newMemoryStore())
+
+	state.SetBandwidthLimit(64 * 1024)
+	if got := state.bandwidth.Rate(); got != 64*1024 {
+		t.Errorf("uploads limited to %d bytes/s, want %d", got, 64*1024)
+	}
+
+	state.SetBandwidthLimit(0)
+	if got := state.bandwidth.Rate(); got != 0 {
+		t.Errorf("uploads limited to %d bytes/s after removing the limit", got)
+	}
+}
+
+func TestActiveWindowRunsPastMidnight(t *testing.T) {
+	windows := []UploadWindow{{Days: []string{"Mon"}, Start: "22:00", End: "06:00"}}
+	// 9 March 2026 is a Monday
+	monday := time.Date(2026, time.March, 9, 0, 0, 0, 0, time.UTC)
+
+	for _, c := range []struct {
+		at     time.Time
+		active bool
+	}{
+		{monday.Add(21 * time.Hour), false},
+		{monday.Add(23 * time.Hour), true},
+		{monday.Add(27 * time.Hour), true},
+		{monday.Add(31 * time.Hour), false},
+		// Sunday night is not in the window
+		{monday.Add(-time.Hour), false},
+	} {
+		if got := activeWindow(windows, c.at) == 0; got != c.active {
+			t.Errorf("window active at %s is %v, want %v", c.at, got, c.active)
+		}
+	}
+}
+
+func TestUploadSlotsFollowLimit(t *testing.T) {
+	slots := newUploadSlots()
+	slots.setLimit(1)
+	slots.acquire()
+
+	acquired := make(chan bool)
+	go func() {
+		slots.acquire()
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second upload started with a limit of one")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Raising the limit lets the waiting upload start
+	slots.setLimit(2)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("waiting upload did not start when the limit was raised")
+	}
+
+	// Lowering the limit lets running uploads finish but starts no more
+	slots.setLimit(0)
+	go func() {
+		slots.acquire()
+		acquired <- true
+	}()
+	slots.release()
+	slots.release()
+	select {
+	case <-acquired:
+		t.Fatal("upload started with a limit of zero")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	slots.setLimit(-1)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("waiting upload did not start when the limit was removed")
+	}
+}
+
+func TestScheduleWindowSetsConcurrencyAndBandwidth(t *testing.T) {
+	state := newTestState(t, newMemoryStore())
+	state.SetBandwidthLimit(64 * 1024)
+
+	// A window from midnight to midnight is always active
+	err := state.SetSchedule([]UploadWindow{{Start: "00:00", End: "00:00", Concurrency: 2, BandwidthLimit: 1024}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := state.ScheduleStatus()
+	if !status.Open || status.Concurrency != 2 {
+		t.Errorf("schedule is %+v, want open with 2 uploads", status)
+	}
+	state.slots.mu.Lock()
+	limit := state.slots.limit
+	state.slots.mu.Unlock()
+	if limit != 2 {
+		t.Errorf("%d uploads allowed at once, want 2", limit)
+	}
+	if got := state.bandwidth.Rate(); got != 1024 {
+		t.Errorf("uploads limited to %d bytes/s, want the window's 1024", got)
+	}
+
+	// Without a window bandwidth limit the global limit applies
+	err = state.SetSchedule([]UploadWindow{{Start: "00:00", End: "00:00", Concurrency: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.bandwidth.Rate(); got != 64*1024 {
+		t.Errorf("uploads limited to %d bytes/s, want the global %d", got, 64*1024)
+	}
+}
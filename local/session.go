@@ -1,40 +1,205 @@
 package local
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/deet/picturelife-experimental-uploader/api"
+	"github.com/deet/picturelife-experimental-uploader/util"
 	"log"
 	"os"
+	"time"
 )
 
+// SessionStatus describes whether the uploader has a working access token.
+type SessionStatus struct {
+	LoggedIn  bool
+	Email     string
+	UserId    string
+	ExpiresAt time.Time
+	Waiting   int // uploads waiting for a login
+}
+
+// UpdateToken makes sure there is a working access token, asking for an email
+// and password on stdin if there is none. It is meant for running without the
+// web UI; with the UI, use RestoreSession and log in through the browser.
 func (appState *State) UpdateToken() {
-	token := appState.Api.AccessToken.Token
+	if appState.RestoreSession() {
+		return
+	}
+	appState.PromptLogin()
+}
+
+// RestoreSession checks the saved access token (or the one in the PLTOKEN
+// environment variable) and refreshes it if it has expired. It reports whether
+// the uploader is logged in afterwards.
+func (appState *State) RestoreSession() bool {
+	// Save refreshed tokens so a restart does not need a new login
+	appState.Api.SetTokenRefreshHandler(func(token api.AccessToken) {
+		appState.Save()
+	})
+
+	token := appState.Api.Token().Token
 	envToken := os.Getenv("PLTOKEN")
 	if envToken != "" {
 		log.Println("Using token from PLTOKEN environment variable.")
 		token = envToken
 	}
 
-	if token == "" || appState.Api.CheckToken(token) == false {
-		log.Println("No valid access token found. Please login. Existing token:", token)
-		email, password := "", ""
-		for email == "" || password == "" {
-			fmt.Println("Email: ")
-			fmt.Scanln(&email)
-			fmt.Println("Password: ")
-			fmt.Scanln(&password)
-			appState.Api.AccessToken, _ = appState.Api.Login(email, password)
-			if appState.Api.AccessToken.Token != "" {
-				fmt.Printf("\n\nLogin sucessessful. \n\n", appState.Api.AccessToken.Token)
-				break
-			}
-			os.Setenv("PLTOKEN", appState.Api.AccessToken.Token)
+	validToken := false
+	if token != "" {
+		var err error
+		validToken, err = appState.Api.CheckToken(token)
+		if err != nil {
+			log.Println("Could not check access token:", err)
 		}
-		if appState.Api.AccessToken.Token == "" {
-			panic("No access token")
+	}
+
+	if !validToken && envToken == "" && appState.Api.Token().RefreshToken != "" {
+		log.Println("Access token is no longer valid, trying to refresh it.")
+		refreshed, err := appState.Api.RefreshAccessToken()
+		if err != nil {
+			log.Println("Could not refresh access token:", err)
+		} else {
+			token = refreshed.Token
+			validToken = true
 		}
-	} else {
-		appState.Api.AccessToken = api.AccessToken{Token: token}
+	}
+
+	if !validToken {
+		log.Println("No valid access token found. Please login. Existing token:", api.Redact(token))
+		return false
+	}
+	if token != appState.Api.Token().Token {
+		appState.Api.SetToken(api.AccessToken{Token: token})
+	}
+	appState.setLoggedIn(true)
+	return true
+}
+
+// PromptLogin asks for an email and password on stdin until a login succeeds.
+func (appState *State) PromptLogin() {
+	email, password := "", ""
+	for email == "" || password == "" {
+		fmt.Println("Email: ")
+		fmt.Scanln(&email)
+		fmt.Println("Password: ")
+		fmt.Scanln(&password)
+		err := appState.Login(context.Background(), email, password)
+		if err != nil {
+			fmt.Println("Login failed:", err)
+			email, password = "", ""
+			continue
+		}
+		fmt.Printf("\n\nLogin sucessessful. \n\n")
+	}
+}
+
+// Login logs in with email and password, saves the new access token and
+// resumes the uploads that were waiting for a login.
+func (appState *State) Login(ctx context.Context, email, password string) error {
+	if email == "" || password == "" {
+		return errors.New("Email and password are required.")
+	}
+	token, err := appState.Api.LoginContext(ctx, email, password)
+	if err != nil {
+		return err
+	}
+	appState.loggedInWith(token)
+	return nil
+}
+
+// LoginWithBrowser logs in by approving the uploader on the Picturelife
+// website in the default browser, instead of giving it the password. The
+// address is also logged in case no browser can be opened.
+func (appState *State) LoginWithBrowser(ctx context.Context) error {
+	token, err := appState.Api.LoginWithBrowser(ctx, func(url string) error {
+		log.Println("Log in to Picturelife at", url)
+		if err := util.OpenBrowser(url); err != nil {
+			log.Println("Could not open a browser:", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	appState.loggedInWith(token)
+	return nil
+}
+
+// StartBrowserLogin starts a login like LoginWithBrowser, but returns the
+// address of the Picturelife login page for the caller to open instead of
+// opening it here. The login finishes in the background: web clients get a
+// sessionUpdate event once it is approved, or a browserLoginFailed event with
+// the reason if it is not.
+func (appState *State) StartBrowserLogin(ctx context.Context) (authorizeURL string, err error) {
+	urls := make(chan string, 1)
+	failed := make(chan error, 1)
+	go func() {
+		started := false
+		token, err := appState.Api.LoginWithBrowser(ctx, func(url string) error {
+			log.Println("Log in to Picturelife at", url)
+			started = true
+			urls <- url
+			return nil
+		})
+		if err == nil {
+			appState.loggedInWith(token)
+			return
+		}
+		log.Println("Browser login failed:", err)
+		if !started {
+			failed <- err
+			return
+		}
+		appState.logEvent(Response{Type: "browserLoginFailed", RequestId: "", Data: err.Error()})
+	}()
+
+	select {
+	case authorizeURL = <-urls:
+	case err = <-failed:
 	}
 	return
 }
+
+func (appState *State) loggedInWith(token api.AccessToken) {
+	appState.Api.SetToken(token)
+	appState.Save()
+	log.Println("Logged in as", token.Email)
+	appState.setLoggedIn(true)
+}
+
+// Logout forgets the access token. Uploads of the default account wait until
+// the next login.
+func (appState *State) Logout() {
+	appState.Api.SetToken(api.AccessToken{})
+	appState.Save()
+	log.Println("Logged out")
+	appState.setLoggedIn(false)
+}
+
+func (appState *State) SessionStatus() SessionStatus {
+	appState.sessionLock.Lock()
+	defer appState.sessionLock.Unlock()
+	token := appState.Api.Token()
+	status := SessionStatus{LoggedIn: appState.loggedIn, Waiting: len(appState.waitingFiles)}
+	if status.LoggedIn {
+		status.Email = token.Email
+		status.UserId = token.UserId
+		status.ExpiresAt = token.ExpiresAt
+	}
+	return status
+}
+
+func (appState *State) setLoggedIn(loggedIn bool) {
+	appState.sessionLock.Lock()
+	resume := loggedIn && !appState.loggedIn
+	appState.loggedIn = loggedIn
+	appState.sessionLock.Unlock()
+
+	if resume {
+		appState.resumeAfterLogin("")
+	}
+
+	appState.logEvent(Response{Type: "sessionUpdate", RequestId: "", Data: appState.SessionStatus()})
+}
@@ -0,0 +1,131 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartBrowserLoginReturnsAuthorizeURL(t *testing.T) {
+	_, state := newFakeState(t)
+	state.Logout()
+
+	authorizeURL, err := state.StartBrowserLogin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(authorizeURL, "code_challenge=") {
+		t.Errorf("authorize URL %s has no PKCE challenge", authorizeURL)
+	}
+
+	// The web client opens the address; the fake approves it straight away
+	resp, err := http.Get(authorizeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for !state.SessionStatus().LoggedIn {
+		if time.Now().After(deadline) {
+			t.Fatal("not logged in after approving the login")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// control sends a request to state the way the web UI does and returns the
+// response.
+func control(t *testing.T, state *State, requestType, data string) Response {
+	t.Helper()
+	if state.requestChan == nil {
+		requests := make(chan Request)
+		t.Cleanup(func() { close(requests) })
+		state.RegisterController(requests)
+	}
+	responses := make(chan Response, 1)
+	state.requestChan <- Request{Type: requestType, Id: "1", Data: data, ResponseChan: responses}
+	select {
+	case response := <-responses:
+		return response
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no response to %s", requestType)
+		return Response{}
+	}
+}
+
+func loginData(t *testing.T, email, password string) string {
+	t.Helper()
+	data, err := json.Marshal(LoginData{Email: email, Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestLoginAndLogoutFromController(t *testing.T) {
+	s, state := newFakeState(t)
+
+	response := control(t, state, "logout", "")
+	if status, ok := response.Data.(SessionStatus); !ok || status.LoggedIn {
+		t.Fatalf("logout answered %+v", response)
+	}
+	if state.Api.Token().Token != "" {
+		t.Error("access token kept after logout")
+	}
+
+	response = control(t, state, "login", loginData(t, s.Email, "wrong"))
+	if response.Type != "Error" || !strings.Contains(response.Data.(string), "wrong email or password") {
+		t.Errorf("login with the wrong password answered %+v", response)
+	}
+	if state.SessionStatus().LoggedIn {
+		t.Fatal("logged in with the wrong password")
+	}
+
+	response = control(t, state, "login", "not json")
+	if response.Type != "Error" {
+		t.Errorf("login with invalid data answered %+v", response)
+	}
+
+	response = control(t, state, "login", loginData(t, s.Email, s.Password))
+	status, ok := response.Data.(SessionStatus)
+	if response.Type != "Response" || !ok || !status.LoggedIn || status.Email != s.Email {
+		t.Fatalf("login answered %+v", response)
+	}
+	if got := control(t, state, "sessionStatus", "").Data.(SessionStatus); !got.LoggedIn {
+		t.Errorf("session status is %+v after login", got)
+	}
+}
+
+func TestUploadsWaitForLogin(t *testing.T) {
+	s, state := newFakeState(t)
+	state.Logout()
+
+	path, sig := writeMedia(t, t.TempDir(), "photo.JPG", 1000)
+	handleFile(state, File{Signature: sig, Path: path, Status: "pending"})
+
+	file, _ := state.GetFile(sig)
+	if file.Status != "waiting-for-login" {
+		t.Fatalf("file is %s, want waiting-for-login", file.Status)
+	}
+	if waiting := state.SessionStatus().Waiting; waiting != 1 {
+		t.Errorf("%d uploads waiting, want 1", waiting)
+	}
+	if s.UploadedBytes(sig) != 0 {
+		t.Error("file was uploaded while logged out")
+	}
+
+	if err := state.Login(context.Background(), s.Email, s.Password); err != nil {
+		t.Fatal(err)
+	}
+	resumed, ok := receiveFile(t, state)
+	if !ok || resumed.Signature != sig {
+		t.Fatalf("resumed %+v after login", resumed)
+	}
+	if waiting := state.SessionStatus().Waiting; waiting != 0 {
+		t.Errorf("%d uploads still waiting after login", waiting)
+	}
+}
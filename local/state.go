@@ -1,10 +1,15 @@
 package local
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/deet/picturelife-experimental-uploader/api"
+	"github.com/deet/picturelife-experimental-uploader/credentials"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -14,10 +19,14 @@ type LocalDirectory struct {
 	Upload              bool
 	MissingOnFilesystem bool
 	UpdatedAt           time.Time
+	Album               string
+	AlbumFromFolder     bool
+	Account             string
 }
 
 type File struct {
 	Signature           string
+	Account             string `json:",omitempty"`
 	Path                string
 	PendingMediaId      string
 	MediaId             string
@@ -27,6 +36,30 @@ type File struct {
 	MissingOnFilesystem bool
 	Name                string
 	Extension           string
+	ProcessingErrorData []interface{} `json:",omitempty"`
+	Album               string        `json:",omitempty"`
+	AlbumAdded          bool          `json:",omitempty"`
+	Caption             string        `json:",omitempty"`
+	Keywords            []string      `json:",omitempty"`
+	History             []FileEvent   `json:",omitempty"`
+}
+
+// FileEvent is one step in the upload history of a file.
+type FileEvent struct {
+	Time    time.Time
+	Message string
+}
+
+// maxFileHistory is how many events are kept in a file's history.
+const maxFileHistory = 50
+
+// Record adds message to the file's history, dropping the oldest events once
+// there are more than maxFileHistory.
+func (f *File) Record(message string) {
+	f.History = append(f.History, FileEvent{Time: time.Now(), Message: message})
+	if len(f.History) > maxFileHistory {
+		f.History = f.History[len(f.History)-maxFileHistory:]
+	}
 }
 
 func (f *File) ToJson() string {
@@ -41,6 +74,7 @@ func (f *File) ToJson() string {
 type State struct {
 	Files           map[string]File `json:"Files"`
 	Api             api.API
+	Accounts        map[string]*Account
 	StateFile       string
 	MaxUploadsChan  chan int  `json:"-"`
 	WatchFileChan   chan File `json:"-"`
@@ -52,15 +86,39 @@ type State struct {
 	UploadImages    bool
 	UploadVideo     bool
 	UploadRaw       bool
+	BandwidthLimit  int64
+	Schedule        []UploadWindow
 	observerChan    chan Response `json:"-"`
 	requestChan     chan Request  `json:"-"`
 	Directories     map[string]LocalDirectory
+	directoriesLock *sync.RWMutex
 	watchers        map[string]Watcher
+	watchersLock    *sync.Mutex
+	uploadCancels   map[string]context.CancelCauseFunc
+	uploadsLock     *sync.Mutex
+	bandwidth       *api.BandwidthLimiter
+	slots           *uploadSlots
+	scheduleLock    *sync.Mutex
+	scheduleStatus  ScheduleStatus
+	pausedFiles     []File
+	filesLock       *sync.RWMutex
+	remoteMedia     map[string]map[string]api.Media // by account, then media ID; not saved
+	albumIds        map[string]string
+	albumsLock      *sync.Mutex
+	sessionLock     *sync.Mutex
+	loggedIn        bool
+	waitingFiles    []File
+	credentials     credentials.Store
+	credentialsLock *sync.Mutex
+	storedSecrets   map[string]storedSecrets
+	credentialsErr  string
+	accountsLock    *sync.Mutex
 }
 
 func NewState(path string) State {
 	var ns State
 	ns.Files = make(map[string]File)
+	ns.remoteMedia = make(map[string]map[string]api.Media)
 	ns.StateFile = path
 	ns.UploadImages = true
 	ns.UploadVideo = true
@@ -71,7 +129,24 @@ func NewState(path string) State {
 	ns.observerChan = nil
 	ns.requestChan = nil
 	ns.watchers = make(map[string]Watcher)
+	ns.watchersLock = &sync.Mutex{}
+	ns.uploadCancels = make(map[string]context.CancelCauseFunc)
+	ns.uploadsLock = &sync.Mutex{}
+	ns.bandwidth = api.NewBandwidthLimiter(0)
+	ns.Api.SetBandwidthLimiter(ns.bandwidth)
+	ns.slots = newUploadSlots()
+	ns.scheduleLock = &sync.Mutex{}
+	ns.filesLock = &sync.RWMutex{}
+	ns.albumIds = make(map[string]string)
+	ns.albumsLock = &sync.Mutex{}
+	ns.sessionLock = &sync.Mutex{}
+	ns.credentials = credentials.NewFileStore(filepath.Join(filepath.Dir(path), "credentials.json"), "")
+	ns.credentialsLock = &sync.Mutex{}
+	ns.storedSecrets = make(map[string]storedSecrets)
+	ns.Accounts = make(map[string]*Account)
+	ns.accountsLock = &sync.Mutex{}
 	ns.Directories = make(map[string]LocalDirectory)
+	ns.directoriesLock = &sync.RWMutex{}
 	return ns
 }
 
@@ -99,19 +174,25 @@ func (state *State) logEvent(event Response) {
 
 func (state *State) SetDirectory(d LocalDirectory) {
 	d.UpdatedAt = time.Now()
+	state.directoriesLock.Lock()
 	state.Directories[d.Path] = d
+	state.directoriesLock.Unlock()
 	state.logEvent(Response{Type: "directoryUpdate", RequestId: "", Data: d.Path})
 	state.UpdateDirectoryWatchers()
 }
 
 func (state *State) GetDirectory(path string) (savedDirectory LocalDirectory, ok bool) {
+	state.directoriesLock.RLock()
 	savedDirectory, ok = state.Directories[path]
+	state.directoriesLock.RUnlock()
 	return
 }
 
 func (state *State) DelDirectory(path string) {
+	state.directoriesLock.Lock()
 	_, present := state.Directories[path]
 	delete(state.Directories, path)
+	state.directoriesLock.Unlock()
 	if present {
 		state.logEvent(Response{Type: "directoryDelete", RequestId: "", Data: path})
 	}
@@ -120,13 +201,16 @@ func (state *State) DelDirectory(path string) {
 
 func (state *State) UpdateDirectoryWatchers() {
 	//log.Println("UpdateDirectoryWatchers")
+	state.watchersLock.Lock()
+	defer state.watchersLock.Unlock()
 	for _, watcher := range state.watchers {
 		//log.Println("Stopping watcher", watcher)
 		watcher.Stop()
 	}
-	for path, localDir := range state.Directories {
+	state.watchers = make(map[string]Watcher)
+	for _, localDir := range state.directoryList() {
 		if localDir.Upload {
-			state.WatchFilesystem(path)
+			state.watchLocked(localDir.Path)
 		} else {
 			//log.Println("No watching dir: ", path)
 		}
@@ -134,36 +218,134 @@ func (state *State) UpdateDirectoryWatchers() {
 	//log.Println("end UpdateDirectoryWatchers")
 }
 
+// directoryList returns a copy of the watched directories, so that they can
+// be used without holding directoriesLock.
+func (state *State) directoryList() []LocalDirectory {
+	state.directoriesLock.RLock()
+	defer state.directoriesLock.RUnlock()
+	list := make([]LocalDirectory, 0, len(state.Directories))
+	for _, localDir := range state.Directories {
+		list = append(list, localDir)
+	}
+	return list
+}
+
 func (state *State) UploadWatchedDirectories() {
-	for path, localDir := range state.Directories {
+	for _, localDir := range state.directoryList() {
 		if localDir.Upload {
-			state.UploadDirectory(path, state.DirectFileChan)
+			state.UploadDirectory(localDir.Path, state.DirectFileChan)
 		}
 	}
 }
 
+// SetBandwidthLimit limits the combined rate of all uploads to bytesPerSecond.
+// Zero removes the limit. Uploads already running pick up the new limit. An
+// upload window with its own bandwidth limit overrides this one while it is
+// active.
+func (state *State) SetBandwidthLimit(bytesPerSecond int64) {
+	state.BandwidthLimit = bytesPerSecond
+	log.Println("Bandwidth limit set to", bytesPerSecond, "bytes per second")
+	state.applySchedule()
+}
+
 func (state *State) SetFile(file File) {
 	file.UpdatedAt = time.Now()
-	state.Files[file.Signature] = file
-	state.logEvent(Response{Type: "fileUpdate", RequestId: "", Data: file.Signature})
+	state.filesLock.Lock()
+	state.Files[file.Key()] = file
+	state.filesLock.Unlock()
+	state.logEvent(Response{Type: "fileUpdate", RequestId: "", Data: file.Key()})
 	//log.Println("saved file", file.Signature)
 	//log.Println("total in db", len(state.Files))
 }
 
-func (state *State) GetFile(sig string) (savedFile File, ok bool) {
-	savedFile, ok = state.Files[sig]
+// updateFile calls update with the file stored under key while holding the
+// files lock, so that changes made since the caller read the file are not
+// overwritten. The file is only written if update returns true. It reports
+// whether the file was written.
+func (state *State) updateFile(key string, update func(file *File) bool) bool {
+	state.filesLock.Lock()
+	file, ok := state.Files[key]
+	if !ok || !update(&file) {
+		state.filesLock.Unlock()
+		return false
+	}
+	file.UpdatedAt = time.Now()
+	state.Files[key] = file
+	state.filesLock.Unlock()
+	state.logEvent(Response{Type: "fileUpdate", RequestId: "", Data: key})
+	return true
+}
+
+// GetFile returns the file with the given key; see FileKey.
+func (state *State) GetFile(key string) (savedFile File, ok bool) {
+	state.filesLock.RLock()
+	savedFile, ok = state.Files[key]
+	state.filesLock.RUnlock()
 	//log.Printf("%v", state.Files[sig].Signature)
 	//log.Println("file from db", savedFile)
 	return
 }
 
+// DelFile removes the file with the given key from the library.
+func (state *State) DelFile(key string) {
+	state.filesLock.Lock()
+	_, present := state.Files[key]
+	delete(state.Files, key)
+	state.filesLock.Unlock()
+	if present {
+		state.logEvent(Response{Type: "fileDelete", RequestId: "", Data: key})
+	}
+}
+
+// FindFiles returns every file for which match returns true.
+func (state *State) FindFiles(match func(File) bool) (files []File) {
+	state.filesLock.RLock()
+	defer state.filesLock.RUnlock()
+	for _, file := range state.Files {
+		if match(file) {
+			files = append(files, file)
+		}
+	}
+	return
+}
+
 func (state *State) Save() {
-	jsonBytes, err := json.Marshal(state)
+	// Secrets are kept in the credential store and never in the state file.
+	// If they cannot be stored they are only kept in memory, and the store
+	// is tried again on the next save. The client secret is read from the
+	// client credentials file on every start.
+	state.setCredentialsError(state.saveSecrets())
+
+	state.filesLock.RLock()
+	saved := *state
+	token := state.Api.Token()
+	token.Token = ""
+	token.RefreshToken = ""
+	saved.Api = *state.Api.WithToken(token)
+	saved.Api.ClientSecret = ""
+	state.directoriesLock.RLock()
+	state.accountsLock.Lock()
+	saved.Accounts = make(map[string]*Account, len(state.Accounts))
+	for name, acc := range state.Accounts {
+		scrubbed := *acc
+		scrubbed.AccessToken.Token = ""
+		scrubbed.AccessToken.RefreshToken = ""
+		saved.Accounts[name] = &scrubbed
+	}
+	jsonBytes, err := json.Marshal(&saved)
+	state.accountsLock.Unlock()
+	state.directoriesLock.RUnlock()
+	state.filesLock.RUnlock()
 	if err != nil {
 		log.Println("Could not serialize Files database", err)
 		panic("Could not save state file")
 	}
-	err = ioutil.WriteFile(state.StateFile, jsonBytes, 0660)
+	err = ioutil.WriteFile(state.StateFile, jsonBytes, 0600)
+	if err == nil {
+		// WriteFile only sets the mode of a new file, and state files
+		// written by older versions were readable by everyone
+		err = os.Chmod(state.StateFile, 0600)
+	}
 	if err != nil {
 		log.Println("Could not open file for writing:", err)
 		panic("Could not save state file")
@@ -181,5 +363,9 @@ func (state *State) Load() {
 
 	//var parsed map[string]File
 	json.Unmarshal(file, state)
+	state.loadSecrets()
+	state.requeuePausedFiles()
+	state.requeueWaitingFiles()
+	state.applySchedule()
 	//log.Printf("Results: %v\n", state.files)
 }
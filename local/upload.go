@@ -1,7 +1,10 @@
 package local
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"github.com/deet/picturelife-experimental-uploader/api"
 	"github.com/deet/picturelife-experimental-uploader/util"
 	"log"
 	"os"
@@ -10,17 +13,44 @@ import (
 	"sync"
 )
 
-func (appState *State) HandleFile(file File, uploadWg *sync.WaitGroup) {
+// FileProgress is sent with fileProgress events. Key identifies the file in
+// the library, since the same signature can be uploading to two accounts.
+type FileProgress struct {
+	api.UploadProgress
+	Key string
+}
+
+func (appState *State) HandleFile(ctx context.Context, file File, uploadWg *sync.WaitGroup) {
 	defer uploadWg.Done()
 	defer func() { appState.MaxUploadsChan <- 1 }()
+	defer appState.ReleaseUploadSlot()
 
 	if file.Signature == "" {
 		log.Println("got empty signature for", file.Path)
 		return
 	}
-	existingFile, fileExists := appState.GetFile(file.Signature)
+
+	if !appState.uploadsAllowed() {
+		appState.pauseFile(file)
+		return
+	}
+	if !appState.accountLoggedIn(file.Account) {
+		appState.waitForLogin(file)
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	ctx = api.WithProgress(ctx, func(progress api.UploadProgress) {
+		appState.logEvent(Response{Type: "fileProgress", RequestId: "", Data: FileProgress{UploadProgress: progress, Key: file.Key()}})
+	})
+	appState.registerUpload(file.Key(), cancel)
+	// The signature changes if the file is modified during the upload
+	defer func() { appState.unregisterUpload(file.Key()) }()
+	defer cancel(nil)
+	existingFile, fileExists := appState.GetFile(file.Key())
 	force := false
 	if fileExists {
+		file.History = existingFile.History
 		force = (existingFile.Status == "retrying")
 		//log.Println("file exists", existingFile.Status)
 		if existingFile.Status == "uploaded" {
@@ -36,12 +66,46 @@ func (appState *State) HandleFile(file File, uploadWg *sync.WaitGroup) {
 	existingDeleted := false
 	var err error
 
-	if force {
-		pendingMediaId, mediaId, existingDeleted, err = appState.Api.UploadForce(file.Path, file.Signature, true)
-	} else {
-		pendingMediaId, mediaId, existingDeleted, err = appState.Api.Upload(file.Path, file.Signature)
+	newMedia := api.NewMedia{
+		LocalPath: file.Path,
+		Signature: file.Signature,
+		Caption:   file.Caption,
+		Keywords:  file.Keywords,
+	}
+	file.Record("Upload started")
+	accountApi := appState.apiFor(file.Account)
+	mismatches := 0
+	for {
+		pendingMediaId, mediaId, existingDeleted, err = accountApi.UploadMediaContext(ctx, newMedia, force)
+		if err == nil || !errors.Is(err, api.ErrRulerSignatureMismatch) || ctx.Err() != nil {
+			break
+		}
+		mismatches++
+		file.Record("Ruler calculated a different signature for the uploaded bytes")
+		if mismatches > maxSignatureMismatchRetries {
+			file.Record(fmt.Sprintf("Giving up after %d signature mismatches", mismatches))
+			break
+		}
+		oldSignature := file.Signature
+		file = appState.rehashFile(file, cancel)
+		// Ruler keeps the partial upload under the signature it was sent
+		// with. Restarting only discards the upload under the new one.
+		if file.Signature != oldSignature {
+			if discardErr := accountApi.DiscardUploadContext(ctx, file.Path, oldSignature); discardErr != nil {
+				log.Println("Could not discard partial upload:", discardErr)
+			}
+		}
+		newMedia.Signature = file.Signature
+		newMedia.RestartUpload = true
+		file.Record("Discarding the partial upload and starting again")
+		appState.SetFile(file)
 	}
 	if err == nil {
+		// The caption and keywords are only sent with a newly created media
+		if pendingMediaId == "" {
+			file.Caption = ""
+			file.Keywords = nil
+		}
 		if pendingMediaId == "" && mediaId == "" {
 			file.Status = "errored"
 			log.Println("Upload failed: no pending media and no media ID")
@@ -49,6 +113,8 @@ func (appState *State) HandleFile(file File, uploadWg *sync.WaitGroup) {
 			file.PendingMediaId = pendingMediaId
 			file.MediaId = mediaId
 			file.Status = "uploaded"
+			file.Album = appState.albumFor(file.Path)
+			file = appState.assignAlbum(ctx, file)
 			if mediaId != "" {
 				log.Printf("File (%s) previously uploaded and processed. Media ID: %s\n", file.Path, mediaId)
 				if existingDeleted {
@@ -58,16 +124,109 @@ func (appState *State) HandleFile(file File, uploadWg *sync.WaitGroup) {
 			} else if pendingMediaId != "" {
 				log.Printf("File (%s) uploaded and processing. Pending media ID: %s\n", file.Path, pendingMediaId)
 			}
+			file.Record("Upload finished, status " + file.Status)
+		}
+	} else if errors.Is(context.Cause(ctx), errUploadPaused) {
+		file.Record("Upload paused until the next upload window")
+		appState.pauseFile(file)
+		return
+	} else if errors.Is(context.Cause(ctx), errSessionExpired) || api.IsUnauthorized(err) {
+		// The token was refreshed if it could be, so the session is over
+		if file.Account == "" {
+			appState.SessionExpired()
+		} else {
+			appState.AccountSessionExpired(file.Account)
 		}
+		appState.waitForLogin(file)
+		return
+	} else if errors.Is(err, context.Canceled) {
+		file.Status = "cancelled"
+		file.Record("Upload cancelled")
+		log.Println("Upload cancelled:", file.Path)
 	} else {
 		file.Status = "errored"
+		file.Record("Upload failed: " + err.Error())
 		log.Println("Upload failed:", err)
 	}
 	appState.SetFile(file)
 	appState.Save()
 }
 
+// maxSignatureMismatchRetries is how many times an upload is started again
+// after Ruler calculates a different signature for the bytes it received.
+const maxSignatureMismatchRetries = 3
+
+// rehashFile recalculates the signature of file after Ruler reported a
+// signature mismatch. If the file changed, its library entry and in-flight
+// upload move to the new signature.
+func (state *State) rehashFile(file File, cancel context.CancelCauseFunc) File {
+	signature := util.CalculateSignature(file.Path)
+	if signature == "" {
+		file.Record("Could not re-read the file, keeping the signature")
+		return file
+	}
+	if signature == file.Signature {
+		file.Record("File unchanged, signature matches")
+		return file
+	}
+
+	file.Record(fmt.Sprintf("File changed during the upload, signature was %s and is now %s", file.Signature, signature))
+	log.Printf("File (%s) changed during the upload. New signature: %s\n", file.Path, signature)
+	state.unregisterUpload(file.Key())
+	state.DelFile(file.Key())
+	file.Signature = signature
+	state.registerUpload(file.Key(), cancel)
+	return file
+}
+
+// pauseFile records that file is waiting for the next upload window.
+func (state *State) pauseFile(file File) {
+	log.Println("Upload paused until the next upload window:", file.Path)
+	file.Status = "paused"
+	state.SetFile(file)
+	state.addPausedFile(file)
+	state.Save()
+}
+
+func (state *State) registerUpload(key string, cancel context.CancelCauseFunc) {
+	state.uploadsLock.Lock()
+	defer state.uploadsLock.Unlock()
+	if state.uploadCancels == nil {
+		state.uploadCancels = make(map[string]context.CancelCauseFunc)
+	}
+	state.uploadCancels[key] = cancel
+}
+
+func (state *State) unregisterUpload(key string) {
+	state.uploadsLock.Lock()
+	defer state.uploadsLock.Unlock()
+	delete(state.uploadCancels, key)
+}
+
+// CancelUpload cancels the in-flight upload of the file with the given key.
+// It returns false if that file is not currently being uploaded.
+func (state *State) CancelUpload(key string) bool {
+	state.uploadsLock.Lock()
+	defer state.uploadsLock.Unlock()
+	cancel, ok := state.uploadCancels[key]
+	if ok {
+		cancel(nil)
+	}
+	return ok
+}
+
 func (state *State) visitFile(path string, info os.FileInfo, err error, c chan File, retrying bool) (retErr error) {
+	file, ok := state.prepareFile(path, info, retrying)
+	if ok {
+		c <- file
+	}
+	return
+}
+
+// prepareFile checks whether the file at path should be uploaded and records
+// it as pending. ok is false for directories and for media types whose
+// uploads are disabled.
+func (state *State) prepareFile(path string, info os.FileInfo, retrying bool) (file File, ok bool) {
 	if info.IsDir() {
 		log.Println("Directory, skipping")
 		return
@@ -107,14 +266,21 @@ func (state *State) visitFile(path string, info os.FileInfo, err error, c chan F
 		}
 	}
 	signature := util.CalculateSignature(path)
-	file := File{
+	file = File{
 		Signature:           signature,
+		Account:             state.accountFor(path),
 		Path:                path,
 		Extension:           extension,
 		Name:                filepath.Base(path),
 		MissingOnFilesystem: false,
 	}
-	_, exists := state.GetFile(signature)
+	if recognizedFormat {
+		metadata := util.ReadMetadata(path)
+		file.Caption = metadata.Caption
+		file.Keywords = metadata.Keywords
+	}
+	existingFile, exists := state.GetFile(file.Key())
+	file.History = existingFile.History
 
 	if !exists {
 		file.Status = "pending"
@@ -128,8 +294,91 @@ func (state *State) visitFile(path string, info os.FileInfo, err error, c chan F
 		log.Println("Unrecognized format")
 		file.Status = "rejected_format"
 	}
-	c <- file
+	ok = true
+
+	return
+}
+
+// queueBatch checks the signatures of files with the server in one call per
+// account and queues only the files that still need uploading on c. Files the
+// server already has are recorded as uploaded or uploaded-deleted straight
+// away. If a check fails every file of that account is queued and HandleFile
+// checks them one by one. Files of accounts that are not logged in wait for
+// the next login of their account.
+func (state *State) queueBatch(files []File, c chan File) (queued, uploaded int64) {
+	if len(files) == 0 {
+		return
+	}
+
+	sigs := make(map[string][]string)
+	skip := make(map[string]bool)
+	loggedIn := make(map[string]bool)
+	held := make(map[string]bool)
+	for _, file := range files {
+		existingFile, exists := state.GetFile(file.Key())
+		if exists && existingFile.Status == "uploaded" && (existingFile.MediaId != "" || existingFile.PendingMediaId != "") {
+			skip[file.Key()] = true
+			continue
+		}
+		if _, checked := loggedIn[file.Account]; !checked {
+			loggedIn[file.Account] = state.accountLoggedIn(file.Account)
+		}
+		if !loggedIn[file.Account] {
+			state.holdForLogin(file)
+			held[file.Key()] = true
+			continue
+		}
+		sigs[file.Account] = append(sigs[file.Account], file.Signature)
+	}
+	if len(held) > 0 {
+		state.Save()
+		// An account may have logged in while its files were held
+		for account, ok := range loggedIn {
+			if !ok && state.accountLoggedIn(account) {
+				state.resumeAfterLogin(account)
+			}
+		}
+	}
+
+	remote := make(map[string]map[string]api.SignatureResponse)
+	for account, accountSigs := range sigs {
+		var err error
+		remote[account], err = state.apiFor(account).CheckSignatures(accountSigs)
+		if err != nil {
+			log.Println("Could not check signatures, checking files individually:", err)
+		}
+	}
+
+	for _, file := range files {
+		if skip[file.Key()] {
+			uploaded++
+			continue
+		}
+		if held[file.Key()] {
+			continue
+		}
+		sigResponse, found := remote[file.Account][file.Signature]
+		if found && sigResponse.MediaId != "" {
+			file.MediaId = sigResponse.MediaId
+			file.Status = "uploaded"
+			if sigResponse.Deleted {
+				file.Status = "uploaded-deleted"
+				log.Printf("File (%s) previously deleted. Media ID: %s\n", file.Path, file.MediaId)
+			} else {
+				log.Printf("File (%s) previously uploaded and processed. Media ID: %s\n", file.Path, file.MediaId)
+				file.Album = state.albumFor(file.Path)
+			}
+			state.SetFile(file)
+			uploaded++
+			continue
+		}
+		c <- file
+		queued++
+	}
 
+	if uploaded > 0 {
+		state.Save()
+	}
 	return
 }
 
@@ -168,10 +417,31 @@ func (state *State) UploadDirectory(path string, c chan File) (found, uploaded i
 		return
 	}
 
+	batchSize := state.Api.SignatureBatchSize()
+	batch := []File{}
+	queueBatch := func() {
+		_, batchUploaded := state.queueBatch(batch, c)
+		found += int64(len(batch))
+		uploaded += batchUploaded
+		batch = []File{}
+	}
+
 	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Println("Could not read", path, err)
+			return nil
+		}
 		log.Println("Checking file", path)
-		return state.visitFile(path, info, err, c, false)
+		file, ok := state.prepareFile(path, info, false)
+		if ok {
+			batch = append(batch, file)
+		}
+		if len(batch) >= batchSize {
+			queueBatch()
+		}
+		return nil
 	})
+	queueBatch()
 
 	//close(c)
 	return
@@ -0,0 +1,219 @@
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deet/picturelife-experimental-uploader/api/apitest"
+	"github.com/deet/picturelife-experimental-uploader/util"
+)
+
+func TestHandleFileUploads(t *testing.T) {
+	s, state := newFakeState(t)
+	path, sig := writeMedia(t, t.TempDir(), "photo.JPG", 1000)
+
+	handleFile(state, File{Signature: sig, Path: path, Status: "pending"})
+
+	file, ok := state.GetFile(sig)
+	if !ok || file.Status != "uploaded" || file.PendingMediaId == "" {
+		t.Fatalf("file is %+v", file)
+	}
+	if s.UploadedBytes(sig) != 1000 {
+		t.Errorf("Ruler holds %d bytes, want 1000", s.UploadedBytes(sig))
+	}
+}
+
+func TestHandleFileReportsProgress(t *testing.T) {
+	_, state := newFakeState(t)
+	events := make(chan Response)
+	state.RegisterObserver(events)
+	path, sig := writeMedia(t, t.TempDir(), "photo.JPG", 1000)
+
+	handleFile(state, File{Signature: sig, Path: path, Status: "pending"})
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-events:
+			progress, ok := event.Data.(FileProgress)
+			if event.Type != "fileProgress" || !ok {
+				continue
+			}
+			if progress.Key != sig {
+				t.Fatalf("progress for %q, want %q", progress.Key, sig)
+			}
+			if progress.BytesSent == progress.Total {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no progress event for the whole file")
+		}
+	}
+}
+
+func TestHandleFileFindsMediaOnServer(t *testing.T) {
+	s, state := newFakeState(t)
+	path, sig := writeMedia(t, t.TempDir(), "photo.JPG", 1000)
+	mediaId := s.AddMedia(sig, false)
+
+	handleFile(state, File{Signature: sig, Path: path, Status: "pending"})
+
+	file, _ := state.GetFile(sig)
+	if file.Status != "uploaded" || file.MediaId != mediaId {
+		t.Fatalf("file is %+v, want uploaded as %s", file, mediaId)
+	}
+	if s.UploadedBytes(sig) != 0 {
+		t.Errorf("file was sent to Ruler again")
+	}
+}
+
+func TestHandleFileResumesDroppedUpload(t *testing.T) {
+	s, state := newFakeState(t)
+	state.Api.SetChunkSize(1000)
+	path, sig := writeMedia(t, t.TempDir(), "photo.JPG", 3500)
+	s.Fail(apitest.Failure{Path: "ruler", Method: "PUT", Times: 1, DropAfterBytes: 1500})
+
+	handleFile(state, File{Signature: sig, Path: path, Status: "pending"})
+
+	file, _ := state.GetFile(sig)
+	if file.Status != "uploaded" {
+		t.Fatalf("file is %+v", file)
+	}
+	if s.UploadedBytes(sig) != 3500 {
+		t.Errorf("Ruler holds %d bytes, want 3500", s.UploadedBytes(sig))
+	}
+}
+
+func TestHandleFileGivesUpAfterSignatureMismatches(t *testing.T) {
+	s, state := newFakeState(t)
+	path, sig := writeMedia(t, t.TempDir(), "photo.JPG", 1000)
+	s.Fail(apitest.Failure{Path: "ruler", Method: "PUT", SignatureMismatch: true})
+
+	handleFile(state, File{Signature: sig, Path: path, Status: "pending"})
+
+	file, _ := state.GetFile(sig)
+	if file.Status != "errored" {
+		t.Fatalf("file is %+v, want errored", file)
+	}
+	if got := s.UploadDeletes(sig); got != maxSignatureMismatchRetries {
+		t.Errorf("partial upload discarded %d times, want %d", got, maxSignatureMismatchRetries)
+	}
+	if s.Calls("medias/create") != 0 {
+		t.Error("media was created from a mismatched upload")
+	}
+}
+
+func TestUploadDirectoryQueuesNewFiles(t *testing.T) {
+	s, state := newFakeState(t)
+	dir := t.TempDir()
+	_, newSig := writeMedia(t, dir, "new.JPG", 1000)
+	_, onServerSig := writeMedia(t, dir, "on-server.JPG", 1000)
+	_, deletedSig := writeMedia(t, dir, "deleted.JPG", 1000)
+	s.AddMedia(onServerSig, false)
+	s.AddMedia(deletedSig, true)
+
+	found, uploaded, err := state.UploadDirectory(dir, state.DirectFileChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != 3 || uploaded != 2 {
+		t.Errorf("found %d and uploaded %d, want 3 and 2", found, uploaded)
+	}
+	if len(state.DirectFileChan) != 1 {
+		t.Fatalf("%d files queued, want 1", len(state.DirectFileChan))
+	}
+	if queued := <-state.DirectFileChan; queued.Signature != newSig {
+		t.Errorf("queued %s, want the new file", queued.Path)
+	}
+	if file, _ := state.GetFile(onServerSig); file.Status != "uploaded" {
+		t.Errorf("file on the server is %s", file.Status)
+	}
+	if file, _ := state.GetFile(deletedSig); file.Status != "uploaded-deleted" {
+		t.Errorf("deleted file is %s", file.Status)
+	}
+	if s.Calls("medias/check_signatures") != 1 {
+		t.Errorf("checked signatures in %d calls, want 1", s.Calls("medias/check_signatures"))
+	}
+}
+
+func TestUploadSendsSidecarCaptionAndKeywords(t *testing.T) {
+	s, state := newFakeState(t)
+	dir := t.TempDir()
+	_, sig := writeMedia(t, dir, "photo.JPG", 1000)
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/">
+   <dc:description><rdf:Alt><rdf:li xml:lang="x-default">Sunset</rdf:li></rdf:Alt></dc:description>
+   <dc:subject><rdf:Bag><rdf:li>beach</rdf:li><rdf:li>Smith, John</rdf:li></rdf:Bag></dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+	if err := os.WriteFile(filepath.Join(dir, "photo.xmp"), []byte(xmp), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := state.UploadDirectory(dir, state.DirectFileChan); err != nil {
+		t.Fatal(err)
+	}
+	queued, ok := receiveFile(t, state)
+	if !ok {
+		t.Fatal("photo was not queued")
+	}
+	if queued.Caption != "Sunset" || !reflect.DeepEqual(queued.Keywords, []string{"beach", "Smith, John"}) {
+		t.Errorf("queued with caption %q and keywords %q", queued.Caption, queued.Keywords)
+	}
+
+	handleFile(state, queued)
+
+	if tags := s.MediaTags(sig); !reflect.DeepEqual(tags, []string{"beach", "Smith, John"}) {
+		t.Errorf("media created with tags %q", tags)
+	}
+}
+
+func TestUploadDirectorySkipsUploadedFiles(t *testing.T) {
+	s, state := newFakeState(t)
+	dir := t.TempDir()
+	path, sig := writeMedia(t, dir, "photo.JPG", 1000)
+	handleFile(state, File{Signature: sig, Path: path, Status: "pending"})
+
+	found, uploaded, err := state.UploadDirectory(dir, state.DirectFileChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != 1 || uploaded != 1 || len(state.DirectFileChan) != 0 {
+		t.Errorf("found %d, uploaded %d and queued %d, want 1, 1 and 0", found, uploaded, len(state.DirectFileChan))
+	}
+	if s.Calls("medias/check_signatures") != 1 {
+		t.Errorf("uploaded file was checked with the server again")
+	}
+}
+
+func TestFileChangedDuringUploadDiscardsOldUpload(t *testing.T) {
+	s, state := newFakeState(t)
+	path, oldSig := writeMedia(t, t.TempDir(), "photo.JPG", 1000)
+	// The file changes after its signature was calculated, so Ruler
+	// receives bytes that do not match it
+	if err := os.WriteFile(path, []byte("changed contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newSig := util.CalculateSignature(path)
+
+	handleFile(state, File{Signature: oldSig, Path: path, Status: "pending"})
+
+	if s.UploadDeletes(oldSig) == 0 {
+		t.Error("partial upload of the old signature was not discarded")
+	}
+	if _, ok := state.GetFile(oldSig); ok {
+		t.Error("file is still recorded with the old signature")
+	}
+	file, ok := state.GetFile(newSig)
+	if !ok || file.Status != "uploaded" {
+		t.Fatalf("file with the new signature is %+v", file)
+	}
+	if s.UploadedBytes(newSig) != int64(len("changed contents")) {
+		t.Errorf("Ruler holds %d bytes of the new file", s.UploadedBytes(newSig))
+	}
+}
@@ -1,9 +1,9 @@
 package local
 
 import (
-	"github.com/deet/picturelife-experimental-uploader/util"
 	"github.com/howeyc/fsnotify"
 	"log"
+	"os"
 )
 
 type Watcher struct {
@@ -14,6 +14,16 @@ type Watcher struct {
 }
 
 func (s *State) WatchFilesystem(path string) {
+	s.watchersLock.Lock()
+	defer s.watchersLock.Unlock()
+	s.watchLocked(path)
+}
+
+// watchLocked starts watching path. The caller must hold watchersLock.
+func (s *State) watchLocked(path string) {
+	if old, ok := s.watchers[path]; ok {
+		old.Stop()
+	}
 	log.Println("Making watcher for directory:", path)
 	w := NewWatcher(s, path)
 	log.Println("Starting watcher for directory:", path)
@@ -46,24 +56,29 @@ func (w *Watcher) Start() {
 	}
 
 	// Process events
+	w.watching = true
 	go func() {
 		defer func() {
 			watcher.Close()
 			//log.Println("Closed watcher")
 		}()
-		w.watching = true
 		for {
 			select {
 			case ev := <-watcher.Event:
 				log.Println("filesystem event:", ev)
 				if ev.IsCreate() || ev.IsModify() {
+					// Files found by the watcher are prepared like the
+					// ones found by a directory scan, so they get the same
+					// account, caption and keywords
 					path := ev.Name
-					signature := util.CalculateSignature(path)
-					file := File{
-						Signature: signature,
-						Path:      path,
+					info, err := os.Stat(path)
+					if err != nil {
+						log.Println("Could not stat watched file:", err)
+						continue
+					}
+					if file, ok := w.s.prepareFile(path, info, false); ok {
+						w.s.WatchFileChan <- file
 					}
-					w.s.WatchFileChan <- file
 				}
 			case err := <-watcher.Error:
 				log.Println("error:", err)
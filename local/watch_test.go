@@ -0,0 +1,34 @@
+package local
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestUpdateDirectoryWatchersReplacesWatchers(t *testing.T) {
+	state := newTestState(t, newMemoryStore())
+	watched, unwatched := t.TempDir(), t.TempDir()
+	state.Directories[watched] = LocalDirectory{Path: watched, Upload: true}
+	state.Directories[unwatched] = LocalDirectory{Path: unwatched}
+	t.Cleanup(func() {
+		state.Directories = map[string]LocalDirectory{}
+		state.UpdateDirectoryWatchers()
+	})
+
+	// Directories are updated from several controller requests at once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state.UpdateDirectoryWatchers()
+		}()
+	}
+	wg.Wait()
+
+	state.watchersLock.Lock()
+	defer state.watchersLock.Unlock()
+	if _, ok := state.watchers[watched]; len(state.watchers) != 1 || !ok {
+		t.Errorf("watching %v, want only %s", state.watchers, watched)
+	}
+}
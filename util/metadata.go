@@ -0,0 +1,234 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dcNamespace  = "http://purl.org/dc/elements/1.1/"
+	rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+)
+
+var (
+	jpegXMPHeader       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegPhotoshopHeader = []byte("Photoshop 3.0\x00")
+)
+
+// Metadata is the caption and keywords a photo was tagged with.
+type Metadata struct {
+	Caption  string
+	Keywords []string
+}
+
+func (m Metadata) Empty() bool {
+	return m.Caption == "" && len(m.Keywords) == 0
+}
+
+// ReadMetadata finds the caption and keywords of the file at filePath. An XMP
+// sidecar next to the file (photo.xmp as written by Lightroom, or
+// photo.NEF.xmp as written by darktable) is preferred. Otherwise JPEGs are
+// read for embedded XMP, then for IPTC.
+func ReadMetadata(filePath string) (metadata Metadata) {
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	for _, sidecar := range []string{filePath + ".xmp", filePath + ".XMP", base + ".xmp", base + ".XMP"} {
+		data, err := ioutil.ReadFile(sidecar)
+		if err != nil {
+			continue
+		}
+		metadata = ParseXMP(data)
+		if !metadata.Empty() {
+			return
+		}
+	}
+
+	extension := strings.ToUpper(filepath.Ext(filePath))
+	if extension != ".JPG" && extension != ".JPEG" {
+		return
+	}
+	xmp, iptc := readJPEGMetadata(filePath)
+	metadata = ParseXMP(xmp)
+	fromIPTC := ParseIPTC(iptc)
+	if metadata.Caption == "" {
+		metadata.Caption = fromIPTC.Caption
+	}
+	if len(metadata.Keywords) == 0 {
+		metadata.Keywords = fromIPTC.Keywords
+	}
+	return
+}
+
+// ParseXMP reads the caption (dc:description) and keywords (dc:subject) from
+// an XMP packet. Only the first language of the caption is used.
+func ParseXMP(data []byte) (metadata Metadata) {
+	if len(data) == 0 {
+		return
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	field := ""
+	inItem := false
+	var text bytes.Buffer
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Space == dcNamespace && (t.Name.Local == "description" || t.Name.Local == "subject") {
+				field = t.Name.Local
+			} else if field != "" && t.Name.Space == rdfNamespace && t.Name.Local == "li" {
+				inItem = true
+				text.Reset()
+			}
+		case xml.CharData:
+			if inItem {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if inItem && t.Name.Space == rdfNamespace && t.Name.Local == "li" {
+				inItem = false
+				value := strings.TrimSpace(text.String())
+				if value == "" {
+					continue
+				}
+				if field == "description" && metadata.Caption == "" {
+					metadata.Caption = value
+				} else if field == "subject" {
+					metadata.Keywords = append(metadata.Keywords, value)
+				}
+			} else if t.Name.Space == dcNamespace && t.Name.Local == field {
+				field = ""
+			}
+		}
+	}
+	return
+}
+
+// ParseIPTC reads the caption (2:120) and keywords (2:25) from IPTC-IIM
+// records.
+func ParseIPTC(data []byte) (metadata Metadata) {
+	for len(data) >= 5 && data[0] == 0x1C {
+		record, dataset := data[1], data[2]
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+		if size&0x8000 != 0 {
+			// Extended datasets are never used for captions or keywords
+			break
+		}
+		data = data[5:]
+		if size > len(data) {
+			break
+		}
+		value := strings.TrimSpace(string(data[:size]))
+		data = data[size:]
+
+		if record != 2 || value == "" {
+			continue
+		}
+		switch dataset {
+		case 120:
+			metadata.Caption = value
+		case 25:
+			metadata.Keywords = append(metadata.Keywords, value)
+		}
+	}
+	return
+}
+
+// readJPEGMetadata returns the XMP packet and the IPTC records embedded in
+// the JPEG at filePath, if any. Only the header segments are read.
+func readJPEGMetadata(filePath string) (xmp, iptc []byte) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	soi := make([]byte, 2)
+	if _, err = io.ReadFull(reader, soi); err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return
+	}
+
+	for {
+		marker, err := reader.ReadByte()
+		if err != nil || marker != 0xFF {
+			return
+		}
+		for marker == 0xFF {
+			if marker, err = reader.ReadByte(); err != nil {
+				return
+			}
+		}
+		// Image data starts at SOS, and nothing of interest follows it
+		if marker == 0xDA || marker == 0xD9 {
+			return
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+
+		length := make([]byte, 2)
+		if _, err = io.ReadFull(reader, length); err != nil {
+			return
+		}
+		size := int(binary.BigEndian.Uint16(length)) - 2
+		if size < 0 {
+			return
+		}
+		segment := make([]byte, size)
+		if _, err = io.ReadFull(reader, segment); err != nil {
+			return
+		}
+
+		if marker == 0xE1 && xmp == nil && bytes.HasPrefix(segment, jpegXMPHeader) {
+			xmp = segment[len(jpegXMPHeader):]
+		}
+		if marker == 0xED && iptc == nil && bytes.HasPrefix(segment, jpegPhotoshopHeader) {
+			iptc = photoshopIPTC(segment[len(jpegPhotoshopHeader):])
+		}
+	}
+}
+
+// photoshopIPTC finds the IPTC-NAA resource (0x0404) among the Photoshop
+// image resources of an APP13 segment.
+func photoshopIPTC(data []byte) []byte {
+	for len(data) >= 12 && string(data[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(data[4:6])
+		// The resource name is a Pascal string padded to an even length
+		nameLength := int(data[6])
+		pos := 7 + nameLength
+		if nameLength%2 == 0 {
+			pos++
+		}
+		if pos+4 > len(data) {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		pos += 4
+		if size < 0 || pos+size > len(data) {
+			return nil
+		}
+		if id == 0x0404 {
+			return data[pos : pos+size]
+		}
+		pos += size
+		if size%2 == 1 {
+			pos++
+		}
+		if pos > len(data) {
+			return nil
+		}
+		data = data[pos:]
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/">
+   <dc:description>
+    <rdf:Alt>
+     <rdf:li xml:lang="x-default">Sunset at the beach</rdf:li>
+     <rdf:li xml:lang="de">Sonnenuntergang am Strand</rdf:li>
+    </rdf:Alt>
+   </dc:description>
+   <dc:subject>
+    <rdf:Bag>
+     <rdf:li>beach</rdf:li>
+     <rdf:li>Smith, John</rdf:li>
+     <rdf:li> </rdf:li>
+    </rdf:Bag>
+   </dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+func TestParseXMP(t *testing.T) {
+	metadata := ParseXMP([]byte(testXMP))
+	want := Metadata{Caption: "Sunset at the beach", Keywords: []string{"beach", "Smith, John"}}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("ParseXMP returned %+v, want %+v", metadata, want)
+	}
+}
+
+func TestParseXMPWithoutMetadata(t *testing.T) {
+	for _, data := range []string{"", "not xml", `<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`} {
+		if metadata := ParseXMP([]byte(data)); !metadata.Empty() {
+			t.Errorf("ParseXMP(%q) returned %+v", data, metadata)
+		}
+	}
+}
+
+// iptcDataset encodes one IPTC-IIM dataset of record 2.
+func iptcDataset(dataset byte, value string) []byte {
+	return append([]byte{0x1C, 2, dataset, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+func TestParseIPTC(t *testing.T) {
+	var data []byte
+	data = append(data, iptcDataset(0, "\x00\x04")...)
+	data = append(data, iptcDataset(120, "Sunset")...)
+	data = append(data, iptcDataset(25, "beach")...)
+	data = append(data, iptcDataset(25, "Smith, John")...)
+
+	metadata := ParseIPTC(data)
+	want := Metadata{Caption: "Sunset", Keywords: []string{"beach", "Smith, John"}}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("ParseIPTC returned %+v, want %+v", metadata, want)
+	}
+}
+
+func TestParseIPTCTruncated(t *testing.T) {
+	data := iptcDataset(120, "Sunset")
+	metadata := ParseIPTC(data[:len(data)-1])
+	if !metadata.Empty() {
+		t.Errorf("ParseIPTC of a truncated dataset returned %+v", metadata)
+	}
+}
+
+func TestReadMetadataPrefersSidecar(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "photo.NEF")
+	if err := os.WriteFile(path, []byte("raw"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "photo.xmp"), []byte(testXMP), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := ReadMetadata(path)
+	if metadata.Caption != "Sunset at the beach" || len(metadata.Keywords) != 2 {
+		t.Errorf("ReadMetadata returned %+v", metadata)
+	}
+}
+
+// jpegSegment encodes a JPEG marker segment.
+func jpegSegment(marker byte, data []byte) []byte {
+	size := len(data) + 2
+	return append([]byte{0xFF, marker, byte(size >> 8), byte(size)}, data...)
+}
+
+func TestReadMetadataFromJPEG(t *testing.T) {
+	// The IPTC caption is only used because the XMP has none
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:subject><rdf:Bag><rdf:li>beach</rdf:li></rdf:Bag></dc:subject></rdf:Description></rdf:RDF></x:xmpmeta>`
+	iptc := append(iptcDataset(120, "Sunset"), iptcDataset(25, "ignored")...)
+	resource := append([]byte("8BIM\x04\x04\x00\x00"), byte(len(iptc)>>24), byte(len(iptc)>>16), byte(len(iptc)>>8), byte(len(iptc)))
+	resource = append(resource, iptc...)
+
+	jpeg := []byte{0xFF, 0xD8}
+	jpeg = append(jpeg, jpegSegment(0xE1, append(append([]byte{}, jpegXMPHeader...), xmp...))...)
+	jpeg = append(jpeg, jpegSegment(0xED, append(append([]byte{}, jpegPhotoshopHeader...), resource...))...)
+	jpeg = append(jpeg, 0xFF, 0xDA)
+
+	path := filepath.Join(t.TempDir(), "photo.JPG")
+	if err := os.WriteFile(path, jpeg, 0644); err != nil {
+		t.Fatal(err)
+	}
+	metadata := ReadMetadata(path)
+	want := Metadata{Caption: "Sunset", Keywords: []string{"beach"}}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("ReadMetadata returned %+v, want %+v", metadata, want)
+	}
+}
@@ -3,6 +3,7 @@ package web
 import (
 	"code.google.com/p/go.net/websocket"
 	"encoding/json"
+	"fmt"
 	"github.com/cratonica/trayhost"
 	"github.com/deet/picturelife-experimental-uploader/local"
 	"log"
@@ -98,12 +99,51 @@ func observeState(appState *local.State, c *connection) {
 				rd := []local.LocalDirectory{dir}
 				c.send <- outgoingMessage{Type: "DirectoryUpdate", Data: rd}
 			}
+		case "fileProgress":
+			c.send <- outgoingMessage{Type: "FileProgress", Data: event.Data}
+		case "statusUpdate":
+			c.send <- outgoingMessage{Type: "StatusUpdate", Data: event.Data}
+		case "sessionUpdate":
+			c.send <- outgoingMessage{Type: "SessionUpdate", Data: event.Data}
+		case "sessionExpired":
+			c.send <- outgoingMessage{Type: "SessionExpired", Data: event.Data}
+		case "browserLoginFailed":
+			c.send <- outgoingMessage{Type: "BrowserLoginFailed", Data: event.Data}
+		case "accountsUpdate":
+			c.send <- outgoingMessage{Type: "AccountsUpdate", Data: event.Data}
+		case "fileDelete":
+			c.send <- outgoingMessage{Type: "FileDelete", Data: event.Data.(string)}
 		case "directoryDelete":
 			c.send <- outgoingMessage{Type: "DirectoryDelete", Data: event.Data.(string)}
 		}
 	}
 }
 
+// listenAddress is where the web UI is served. It only listens on loopback so
+// that other machines cannot control the uploader.
+const listenAddress = "127.0.0.1:7111"
+
+// allowedOrigins are the pages that may open the websocket. Any other page the
+// user has open could otherwise log the uploader in to another account.
+var allowedOrigins = map[string]bool{
+	"http://localhost:7111": true,
+	"http://127.0.0.1:7111": true,
+}
+
+// checkOrigin rejects websocket handshakes from pages other than the web UI.
+func checkOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil || !allowedOrigins[origin.Scheme+"://"+origin.Host] {
+		log.Println("Rejected websocket connection from origin:", req.Header.Get("Origin"))
+		return fmt.Errorf("origin %q is not allowed", req.Header.Get("Origin"))
+	}
+	config.Origin = origin
+	return nil
+}
+
 func StartWebUi(appState *local.State) {
 	wd, _ := os.Getwd()
 	base := path.Dir(wd)
@@ -111,17 +151,20 @@ func StartWebUi(appState *local.State) {
 	log.Println("Serving directory:", final)
 	//http.ListenAndServe(":7111", http.FileServer(http.Dir("web/assets")))
 
-	http.Handle("/ws", websocket.Handler(func(ws *websocket.Conn) {
+	http.Handle("/ws", websocket.Server{Handshake: checkOrigin, Handler: func(ws *websocket.Conn) {
 		c := &connection{send: make(chan outgoingMessage, 256), ws: ws}
 		//go sendFiles(appState, c)
 		go observeState(appState, c)
 		go c.writer()
 		c.reader(appState)
-	}))
+	}})
 	http.Handle("/", http.FileServer(http.Dir("web/assets")))
 
 	trayhost.SetUrl("http://localhost:7111")
 
-	http.ListenAndServe(":7111", nil)
+	err := http.ListenAndServe(listenAddress, nil)
+	if err != nil {
+		log.Println("Could not start web UI:", err)
+	}
 
 }